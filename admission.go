@@ -0,0 +1,166 @@
+// Copyright (C) 2018 ecofast(胡光耀). All rights reserved.
+// Use of this source code is governed by a BSD-style license.
+
+package tcpsock
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	rejectLingerTimeout = 100 * time.Millisecond
+)
+
+type OnTcpRejectFrame = func(reason RejectReason) []byte
+
+// RejectWithFrame returns a reject handler that writes the frame onFrame
+// returns for the reason, if any, before the connection is closed, so
+// that clients can tell e.g. a full server from a network error. The
+// frame goes out as is, so it must already be encoded. Connections turned
+// away before the TLS handshake get it in the clear.
+func RejectWithFrame(onFrame OnTcpRejectFrame) OnTcpReject {
+	if onFrame == nil {
+		panic(errors.New("invalid param of onFrame for RejectWithFrame"))
+	}
+
+	return func(conn net.Conn, reason RejectReason) {
+		b := onFrame(reason)
+		if len(b) == 0 {
+			return
+		}
+		// the connection is brand new, so a short frame fits in the
+		// socket buffer at once and the deadline only guards odd cases
+		conn.SetDeadline(time.Now().Add(rejectLingerTimeout))
+		if _, err := conn.Write(b); err != nil {
+			return
+		}
+		// closing with unread data, e.g. a request the client sent right
+		// away, resets the connection, which may take the frame with it;
+		// so half close and read until the peer closes too
+		if conn, ok := conn.(closeWriter); ok {
+			conn.CloseWrite()
+		}
+		io.Copy(io.Discard, conn)
+	}
+}
+
+// admissionQueue holds connections waiting for a slot, first come first
+// served.
+type admissionQueue struct {
+	mutex    sync.Mutex
+	maxLen   int
+	timeout  time.Duration
+	waiters  []chan struct{}
+	stopChan chan struct{}
+	stopOnce sync.Once
+}
+
+// SetAdmissionQueue lets up to maxLen connections that arrive while
+// NumOfConnMax connections are open wait up to timeout for one of them to
+// close, rather than be rejected with RejectFull right away. They are let
+// in in the order they came. It must be called before serving.
+func (self *TcpServer) SetAdmissionQueue(maxLen int, timeout time.Duration) {
+	if maxLen <= 0 || timeout <= 0 {
+		self.admission = nil
+		return
+	}
+	self.admission = &admissionQueue{
+		maxLen:   maxLen,
+		timeout:  timeout,
+		stopChan: make(chan struct{}),
+	}
+}
+
+// stop turns away everybody waiting, and anybody coming, once the server
+// stops accepting.
+func (self *admissionQueue) stop() {
+	self.stopOnce.Do(func() {
+		close(self.stopChan)
+	})
+}
+
+// waitSlot queues for a connection slot and reports whether one was
+// obtained.
+func (self *TcpServer) waitSlot() bool {
+	queue := self.admission
+	if queue == nil {
+		return false
+	}
+
+	queue.mutex.Lock()
+	// a slot freed before the lock was taken isn't handed to anyone, so
+	// check again
+	if self.acquireSlot() {
+		queue.mutex.Unlock()
+		return true
+	}
+	if len(queue.waiters) >= queue.maxLen {
+		queue.mutex.Unlock()
+		return false
+	}
+	ready := make(chan struct{})
+	queue.waiters = append(queue.waiters, ready)
+	queue.mutex.Unlock()
+
+	timer := time.NewTimer(queue.timeout)
+	defer timer.Stop()
+	select {
+	case <-ready:
+		return true
+	case <-timer.C:
+	case <-queue.stopChan:
+	}
+
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	for i, waiter := range queue.waiters {
+		if waiter == ready {
+			queue.waiters = append(queue.waiters[:i], queue.waiters[i+1:]...)
+			return false
+		}
+	}
+	// the slot was handed over just as we gave up; pass it on
+	self.handOver()
+	return false
+}
+
+// releaseSlot gives a closed connection's slot to the first queued
+// connection, if there is one, and frees it otherwise.
+func (self *TcpServer) releaseSlot() {
+	queue := self.admission
+	if queue == nil {
+		atomic.AddUint32(&self.count, ^uint32(0))
+		return
+	}
+
+	queue.mutex.Lock()
+	self.handOver()
+	queue.mutex.Unlock()
+}
+
+// handOver must be called with the queue locked.
+func (self *TcpServer) handOver() {
+	queue := self.admission
+	if len(queue.waiters) == 0 {
+		atomic.AddUint32(&self.count, ^uint32(0))
+		return
+	}
+	close(queue.waiters[0])
+	queue.waiters[0] = nil
+	queue.waiters = queue.waiters[1:]
+}
+
+func (self *TcpServer) queued() int {
+	queue := self.admission
+	if queue == nil {
+		return 0
+	}
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	return len(queue.waiters)
+}
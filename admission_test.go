@@ -0,0 +1,135 @@
+// Copyright (C) 2018 ecofast(胡光耀). All rights reserved.
+// Use of this source code is governed by a BSD-style license.
+
+package tcpsock
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitQueued waits for n connections to be queued for a slot.
+func waitQueued(tb testing.TB, svr *TcpServer, n int) {
+	deadline := time.Now().Add(time.Second)
+	for svr.queued() != n {
+		if time.Now().After(deadline) {
+			tb.Fatalf("%d queued, want %d", svr.queued(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestAdmissionQueue pretends NumOfConnMax connections are open and checks
+// that slots freed by closing ones go to the waiters in order.
+func TestAdmissionQueue(t *testing.T) {
+	svr := newTestServer(t, nil)
+	defer svr.Close()
+	svr.SetAdmissionQueue(2, time.Minute)
+	atomic.StoreUint32(&svr.count, NumOfConnMax)
+
+	got := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		i := i
+		go func() {
+			if svr.waitSlot() {
+				got <- i
+			}
+		}()
+		waitQueued(t, svr, i+1)
+	}
+	if svr.waitSlot() {
+		t.Error("got a slot past a full queue")
+	}
+
+	for i := 0; i < 2; i++ {
+		svr.releaseSlot()
+		select {
+		case n := <-got:
+			if n != i {
+				t.Errorf("waiter %d got slot %d", n, i)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("slot %d not handed over", i)
+		}
+		// a handed over slot stays taken
+		if svr.Count() != NumOfConnMax {
+			t.Errorf("count %d after hand over, want %d", svr.Count(), NumOfConnMax)
+		}
+	}
+	svr.releaseSlot()
+	if svr.Count() != NumOfConnMax-1 {
+		t.Errorf("count %d with nobody waiting, want %d", svr.Count(), NumOfConnMax-1)
+	}
+}
+
+func TestAdmissionQueueGiveUp(t *testing.T) {
+	cases := map[string]struct {
+		timeout time.Duration
+		stop    bool
+	}{
+		"timeout": {50 * time.Millisecond, false},
+		"stop":    {time.Minute, true},
+	}
+	for name, c := range cases {
+		svr := newTestServer(t, nil)
+		svr.SetAdmissionQueue(2, c.timeout)
+		atomic.StoreUint32(&svr.count, NumOfConnMax)
+
+		done := make(chan bool, 1)
+		go func() {
+			done <- svr.waitSlot()
+		}()
+		waitQueued(t, svr, 1)
+		if c.stop {
+			svr.Close()
+		}
+		select {
+		case ok := <-done:
+			if ok {
+				t.Errorf("%s: got a slot", name)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s: still waiting", name)
+		}
+		if svr.queued() != 0 {
+			t.Errorf("%s: %d still queued", name, svr.queued())
+		}
+		svr.Close()
+	}
+}
+
+// TestRejectWithFrame checks that the frame reaches a peer that sent a
+// request of its own before reading, instead of being lost to a reset.
+func TestRejectWithFrame(t *testing.T) {
+	svr := newTestServer(t, nil)
+	svr.SetAcceptRate(0.001, 1)
+	svr.SetRejectHandler(RejectWithFrame(func(reason RejectReason) []byte {
+		if reason != RejectRate {
+			return nil
+		}
+		return []byte("busy")
+	}))
+	svr.Serve()
+	defer svr.Close()
+
+	// the first one uses up the burst
+	first, err := net.Dial("tcp", svr.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	peer, err := net.Dial("tcp", svr.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	peer.Write([]byte("hello"))
+
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	if b, err := io.ReadAll(peer); err != nil || string(b) != "busy" {
+		t.Errorf("got %q, %v, want %q", b, err, "busy")
+	}
+}
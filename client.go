@@ -4,9 +4,12 @@
 package tcpsock
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,10 +17,19 @@ const (
 	TcpDialTimeoutInSecs = 2
 )
 
+var (
+	ErrNotConnected = errors.New("not connected")
+	ErrClientClosed = errors.New("client closed")
+)
+
 type TcpClient struct {
 	svrAddr string
 	*tcpSock
-	*TcpConn
+	conn      *TcpConn
+	mutex     sync.RWMutex
+	dialer    *net.Dialer
+	reconnect *ReconnectPolicy
+	redialing int32
 }
 
 func NewTcpClient(svrAddr string, onConnect OnTcpConnect, onDisconnect OnTcpDisconnect) *TcpClient {
@@ -42,31 +54,200 @@ func NewTcpClient(svrAddr string, onConnect OnTcpConnect, onDisconnect OnTcpDisc
 	}
 }
 
+// SetReconnect makes the client redial according to policy whenever a dial
+// fails or the connection drops. It must be called before Open.
+func (self *TcpClient) SetReconnect(policy *ReconnectPolicy) {
+	self.reconnect = policy
+}
+
+// SetDialer replaces the default dialer, which times out after
+// TcpDialTimeoutInSecs. It must be called before Open.
+func (self *TcpClient) SetDialer(dialer *net.Dialer) {
+	self.dialer = dialer
+}
+
+// Open connects in the same way as OpenContext but doesn't report errors;
+// if the dial fails and a reconnect policy is set, it keeps redialing in
+// the background.
 func (self *TcpClient) Open() {
-	if conn, err := net.DialTimeout("tcp", self.svrAddr, TcpDialTimeoutInSecs*time.Second); err == nil {
-		self.waitGroup.Add(1)
-		go func() {
-			c := newTcpConn(0, self.tcpSock, conn, self.connClose)
-			session := self.onConnect(c)
-			if session != nil {
-				c.onRead = session.Read
-			}
-			self.TcpConn = c
-			c.run()
-			self.waitGroup.Done()
-		}()
-		time.Sleep(100 * time.Millisecond)
+	if err := self.OpenContext(context.Background()); err != nil {
+		self.startRedial()
 	}
 }
 
+// OpenContext dials the server and returns once onConnect has run and the
+// connection is live, or with the error that prevented it. ctx bounds the
+// dial; it is not used after OpenContext returns.
+func (self *TcpClient) OpenContext(ctx context.Context) error {
+	if self.exiting() {
+		return ErrClientClosed
+	}
+	return self.dial(ctx)
+}
+
 func (self *TcpClient) Close() error {
 	close(self.exitChan)
+	// see TcpServer.Close
+	if conn := self.Conn(); conn != nil {
+		conn.closeWith(CloseShutdown, nil)
+	}
 	self.waitGroup.Wait()
 	return nil
 }
 
-func (self *TcpClient) connClose(conn *TcpConn) {
+// Write sends b over the current connection. It is safe to call while the
+// client is reconnecting.
+func (self *TcpClient) Write(b []byte) (n int, err error) {
+	conn := self.Conn()
+	if conn == nil {
+		return 0, ErrNotConnected
+	}
+	return conn.Write(b)
+}
+
+func (self *TcpClient) WriteBuffer(buf *Buffer) (n int, err error) {
+	conn := self.Conn()
+	if conn == nil {
+		buf.Release()
+		return 0, ErrNotConnected
+	}
+	return conn.WriteBuffer(buf)
+}
+
+func (self *TcpClient) WriteFrame(frame []byte) (n int, err error) {
+	conn := self.Conn()
+	if conn == nil {
+		return 0, ErrNotConnected
+	}
+	return conn.WriteFrame(frame)
+}
+
+func (self *TcpClient) Connected() bool {
+	conn := self.Conn()
+	return conn != nil && !conn.closed()
+}
+
+// Conn returns the current connection, which changes on every reconnect,
+// or nil before the first one is made.
+func (self *TcpClient) Conn() *TcpConn {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	return self.conn
+}
+
+func (self *TcpClient) dial(ctx context.Context) error {
+	dialer := self.dialer
+	if dialer == nil {
+		dialer = &net.Dialer{Timeout: TcpDialTimeoutInSecs * time.Second}
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", self.svrAddr)
+	if err != nil {
+		return err
+	}
+	if err = ctx.Err(); err != nil {
+		conn.Close()
+		return err
+	}
+	if conn, err = self.handshake(ctx, conn, self.clientTLSConfig(), true); err != nil {
+		conn.Close()
+		return err
+	}
+
+	c := newTcpConn(0, self.tcpSock, conn, self.connClose)
+	session, err := self.connect(c)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if session != nil {
+		c.onRead = session.Read
+	}
+	self.mutex.Lock()
+	self.conn = c
+	self.mutex.Unlock()
+	c.run()
+	return nil
+}
+
+func (self *TcpClient) clientTLSConfig() *tls.Config {
+	config := self.tlsConfig
+	if config == nil || config.ServerName != "" || config.InsecureSkipVerify {
+		return config
+	}
+	if host, _, err := net.SplitHostPort(self.svrAddr); err == nil {
+		config = config.Clone()
+		config.ServerName = host
+	}
+	return config
+}
+
+func (self *TcpClient) exiting() bool {
+	select {
+	case <-self.exitChan:
+		return true
+	default:
+		return false
+	}
+}
+
+func (self *TcpClient) startRedial() {
+	if self.reconnect == nil || self.exiting() {
+		return
+	}
+	if atomic.CompareAndSwapInt32(&self.redialing, 0, 1) {
+		startGoroutine(self.redial, self.waitGroup)
+	}
+}
+
+func (self *TcpClient) redial() {
+	for self.redialOnce() {
+		atomic.StoreInt32(&self.redialing, 0)
+		// a connection that dropped before the flag was cleared couldn't
+		// start a redial of its own
+		if self.Connected() || self.exiting() || !atomic.CompareAndSwapInt32(&self.redialing, 0, 1) {
+			return
+		}
+	}
+	atomic.StoreInt32(&self.redialing, 0)
+}
+
+// redialOnce dials until connected or the policy gives up, and reports
+// whether it connected.
+func (self *TcpClient) redialOnce() bool {
+	policy := self.reconnect
+	var err error
+	attempt := 1
+	for ; !policy.exhausted(attempt); attempt++ {
+		delay := policy.delay(attempt)
+		if policy.OnAttempt != nil {
+			policy.OnAttempt(attempt, delay)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-self.exitChan:
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+
+		if err = self.dial(context.Background()); err == nil {
+			if policy.OnSuccess != nil {
+				policy.OnSuccess(attempt)
+			}
+			return true
+		}
+	}
+
+	if policy.OnGiveUp != nil {
+		policy.OnGiveUp(attempt-1, err)
+	}
+	return false
+}
+
+func (self *TcpClient) connClose(conn *TcpConn, reason CloseReason) {
 	if self.onDisconnect != nil {
-		self.onDisconnect(conn)
+		self.onDisconnect(conn, reason)
 	}
+	self.startRedial()
 }
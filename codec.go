@@ -0,0 +1,33 @@
+// Copyright (C) 2018 ecofast(胡光耀). All rights reserved.
+// Use of this source code is governed by a BSD-style license.
+
+package tcpsock
+
+import (
+	"errors"
+)
+
+var (
+	ErrFrameTooLarge = errors.New("frame too large")
+	ErrInvalidFrame  = errors.New("invalid frame")
+)
+
+// Codec splits an inbound byte stream into whole frames and encodes
+// outbound frames for the wire.
+//
+// Decode inspects the buffered bytes in b. It returns the first complete
+// frame together with the number of bytes it occupies in b; n == 0 means
+// more data is needed. Any error closes the connection. The returned frame
+// may alias b and is only valid until the session's Read returns.
+//
+// Encode is the inverse of Decode, so Decode(Encode(frame)) yields frame.
+type Codec interface {
+	Decode(b []byte) (frame []byte, n int, err error)
+	Encode(frame []byte) ([]byte, error)
+}
+
+// BufferEncoder can be implemented by a Codec to encode into a pooled
+// Buffer, which WriteFrame then sends without allocating.
+type BufferEncoder interface {
+	EncodeBuffer(frame []byte) (*Buffer, error)
+}
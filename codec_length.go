@@ -0,0 +1,167 @@
+// Copyright (C) 2018 ecofast(胡光耀). All rights reserved.
+// Use of this source code is governed by a BSD-style license.
+
+package tcpsock
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+const (
+	LenSizeVarint = 0
+	LenSize16     = 2
+	LenSize32     = 4
+)
+
+// LengthCodec frames data with a length field at the very start of every
+// packet, optionally followed by extraHead bytes of fixed header (e.g. a
+// command word) that the length does not count. Decoded frames start right
+// after the length field, so they include the extra header bytes; Encode
+// expects frames of the same shape.
+type LengthCodec struct {
+	lenSize     int
+	order       binary.ByteOrder
+	extraHead   int
+	includeHead bool
+}
+
+// NewLengthCodec creates a codec whose length field is lenSize bytes wide
+// (LenSize16, LenSize32 or LenSizeVarint) in the given byte order. When
+// includeHead is true the length covers the length field and the extra
+// header as well, otherwise only what follows them.
+//
+// The chatroom PacketHead (uint16 Len + uint16 Cmd, little endian, Len not
+// counting the head) is NewLengthCodec(LenSize16, binary.LittleEndian, 2, false).
+func NewLengthCodec(lenSize int, order binary.ByteOrder, extraHead int, includeHead bool) *LengthCodec {
+	if lenSize != LenSizeVarint && lenSize != LenSize16 && lenSize != LenSize32 {
+		panic(errors.New("invalid param of lenSize for NewLengthCodec"))
+	}
+	if order == nil && lenSize != LenSizeVarint {
+		panic(errors.New("invalid param of order for NewLengthCodec"))
+	}
+	if extraHead < 0 {
+		panic(errors.New("invalid param of extraHead for NewLengthCodec"))
+	}
+
+	return &LengthCodec{
+		lenSize:     lenSize,
+		order:       order,
+		extraHead:   extraHead,
+		includeHead: includeHead,
+	}
+}
+
+func (self *LengthCodec) Decode(b []byte) (frame []byte, n int, err error) {
+	length, size := self.readLen(b)
+	if size == 0 {
+		return nil, 0, nil
+	}
+	if size < 0 {
+		return nil, 0, ErrInvalidFrame
+	}
+
+	head := uint64(size + self.extraHead)
+	total := length
+	if self.includeHead {
+		if total < head {
+			return nil, 0, ErrInvalidFrame
+		}
+	} else {
+		total += head
+	}
+	if total > RecvBufLenMax || total < length {
+		return nil, 0, ErrFrameTooLarge
+	}
+	if int(total) > len(b) {
+		return nil, 0, nil
+	}
+	return b[size:total], int(total), nil
+}
+
+func (self *LengthCodec) Encode(frame []byte) ([]byte, error) {
+	size, length, err := self.head(frame)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size+len(frame))
+	self.put(buf, size, length, frame)
+	return buf, nil
+}
+
+// EncodeBuffer is Encode into a pooled buffer, see BufferEncoder.
+func (self *LengthCodec) EncodeBuffer(frame []byte) (*Buffer, error) {
+	size, length, err := self.head(frame)
+	if err != nil {
+		return nil, err
+	}
+	buf := GetBuffer(size + len(frame))
+	self.put(buf.Bytes(), size, length, frame)
+	return buf, nil
+}
+
+// head works out the width and value of frame's length field.
+func (self *LengthCodec) head(frame []byte) (size int, length uint64, err error) {
+	if len(frame) < self.extraHead {
+		return 0, 0, ErrInvalidFrame
+	}
+
+	length = uint64(len(frame) - self.extraHead)
+	size = self.lenSize
+	if size == LenSizeVarint {
+		size = varintSize(length)
+		// the length of the varint itself may push it over a byte boundary
+		for self.includeHead && varintSize(length+uint64(size+self.extraHead)) != size {
+			size++
+		}
+	}
+	if self.includeHead {
+		length += uint64(size + self.extraHead)
+	}
+	// the peer's Decode rejects anything it can't receive in one buffer
+	if (self.lenSize == LenSize16 && length > math.MaxUint16) || size+len(frame) > RecvBufLenMax {
+		return 0, 0, ErrFrameTooLarge
+	}
+	return size, length, nil
+}
+
+func (self *LengthCodec) put(buf []byte, size int, length uint64, frame []byte) {
+	switch self.lenSize {
+	case LenSize16:
+		self.order.PutUint16(buf, uint16(length))
+	case LenSize32:
+		self.order.PutUint32(buf, uint32(length))
+	default:
+		binary.PutUvarint(buf, length)
+	}
+	copy(buf[size:], frame)
+}
+
+// readLen returns the length value and the size of the length field; a zero
+// size means more data is needed and a negative one a malformed varint.
+func (self *LengthCodec) readLen(b []byte) (uint64, int) {
+	switch self.lenSize {
+	case LenSize16:
+		if len(b) < LenSize16 {
+			return 0, 0
+		}
+		return uint64(self.order.Uint16(b)), LenSize16
+	case LenSize32:
+		if len(b) < LenSize32 {
+			return 0, 0
+		}
+		return uint64(self.order.Uint32(b)), LenSize32
+	default:
+		return binary.Uvarint(b)
+	}
+}
+
+func varintSize(v uint64) int {
+	n := 1
+	for v >= 0x80 {
+		v >>= 7
+		n++
+	}
+	return n
+}
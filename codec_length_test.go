@@ -0,0 +1,76 @@
+// Copyright (C) 2018 ecofast(胡光耀). All rights reserved.
+// Use of this source code is governed by a BSD-style license.
+
+package tcpsock
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestLengthCodecRoundTrip(t *testing.T) {
+	codecs := map[string]*LengthCodec{
+		"16":              NewLengthCodec(LenSize16, binary.LittleEndian, 0, false),
+		"16 extra":        NewLengthCodec(LenSize16, binary.LittleEndian, 2, false),
+		"32 include":      NewLengthCodec(LenSize32, binary.BigEndian, 0, true),
+		"32 extra":        NewLengthCodec(LenSize32, binary.BigEndian, 4, true),
+		"varint":          NewLengthCodec(LenSizeVarint, nil, 0, false),
+		"varint include":  NewLengthCodec(LenSizeVarint, nil, 1, true),
+		"chatroom header": NewLengthCodec(LenSize16, binary.LittleEndian, 2, false),
+	}
+	sizes := []int{4, 5, 126, 127, 128, 300, 16380}
+
+	for name, codec := range codecs {
+		for _, size := range sizes {
+			frame := make([]byte, size)
+			for i := range frame {
+				frame[i] = byte(i)
+			}
+			b, err := codec.Encode(frame)
+			if err != nil {
+				t.Fatalf("%s: Encode(%d bytes): %v", name, size, err)
+			}
+			buf, err := codec.EncodeBuffer(frame)
+			if err != nil || !bytes.Equal(buf.Bytes(), b) {
+				t.Fatalf("%s: EncodeBuffer(%d bytes) differs from Encode: %v", name, size, err)
+			}
+			buf.Release()
+
+			// a partial packet needs more data
+			if _, n, err := codec.Decode(b[:len(b)-1]); n != 0 || err != nil {
+				t.Fatalf("%s: Decode of partial %d byte packet = %d, %v", name, size, n, err)
+			}
+			// a following packet is left alone
+			got, n, err := codec.Decode(append(b, b...))
+			if err != nil || n != len(b) || !bytes.Equal(got, frame) {
+				t.Fatalf("%s: Decode(Encode(%d bytes)) = %d bytes, n %d, %v", name, size, len(got), n, err)
+			}
+		}
+	}
+}
+
+func TestLengthCodecLimits(t *testing.T) {
+	codec := NewLengthCodec(LenSize32, binary.BigEndian, 0, false)
+	if _, err := codec.Encode(make([]byte, RecvBufLenMax)); err != ErrFrameTooLarge {
+		t.Fatalf("Encode of a frame the peer can't receive = %v, want ErrFrameTooLarge", err)
+	}
+	if _, err := codec.Encode(make([]byte, RecvBufLenMax-LenSize32)); err != nil {
+		t.Fatalf("Encode of the largest frame = %v", err)
+	}
+
+	head := make([]byte, LenSize32)
+	binary.BigEndian.PutUint32(head, RecvBufLenMax)
+	if _, _, err := codec.Decode(head); err != ErrFrameTooLarge {
+		t.Fatalf("Decode of an oversized length = %v, want ErrFrameTooLarge", err)
+	}
+
+	extra := NewLengthCodec(LenSize16, binary.BigEndian, 2, false)
+	if _, err := extra.Encode([]byte{1}); err != ErrInvalidFrame {
+		t.Fatalf("Encode of a frame shorter than the extra header = %v, want ErrInvalidFrame", err)
+	}
+	include := NewLengthCodec(LenSize16, binary.BigEndian, 0, true)
+	if _, _, err := include.Decode([]byte{0, 1}); err != ErrInvalidFrame {
+		t.Fatalf("Decode of a length shorter than the header = %v, want ErrInvalidFrame", err)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"net"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 const (
@@ -16,25 +17,50 @@ const (
 	TcpBufLenMax  = 16 * 1024
 )
 
+var (
+	ErrConnClosed = errors.New("connection closed")
+)
+
 type TcpConn struct {
+	// 64-bit atomics first, so they are aligned on 32-bit platforms
+	traffic    traffic
+	queued     int64
+	lastRead   int64
+	lastWrite  int64
 	id         uint64
 	owner      *tcpSock
 	conn       net.Conn
-	bufChan    chan []byte
+	remote     net.Addr
+	bufChan    chan sendMsg
+	spaceChan  chan struct{}
 	closeChan  chan struct{}
 	closeOnce  sync.Once
+	drainChan  chan struct{}
+	drainOnce  sync.Once
+	drainWhy   CloseReason
+	farewell   []byte
 	closedFlag int32
+	reason     CloseReason
+	closeErr   error
+	startTime  time.Time
 	onClose    OnTcpDisconnect
 	onRead     func(p []byte) (n int, err error)
 }
 
 func newTcpConn(id uint64, owner *tcpSock, conn net.Conn, onClose OnTcpDisconnect) *TcpConn {
+	now := time.Now().UnixNano()
 	return &TcpConn{
 		id:        id,
+		startTime: time.Unix(0, now),
 		owner:     owner,
 		conn:      conn,
-		bufChan:   make(chan []byte, 20),
+		remote:    conn.RemoteAddr(),
+		bufChan:   make(chan sendMsg, owner.queueLen()),
+		spaceChan: make(chan struct{}, 1),
 		closeChan: make(chan struct{}),
+		drainChan: make(chan struct{}),
+		lastRead:  now,
+		lastWrite: now,
 		onClose:   onClose,
 	}
 }
@@ -44,31 +70,136 @@ func (self *TcpConn) ID() uint64 {
 }
 
 func (self *TcpConn) Write(b []byte) (n int, err error) {
+	return self.write(sendMsg{b: b})
+}
+
+// WriteBuffer queues buf for sending and takes over the caller's reference
+// to it, which is released once written, dropped, or right away if an
+// error is returned. buf must already be encoded.
+func (self *TcpConn) WriteBuffer(buf *Buffer) (n int, err error) {
+	return self.write(sendMsg{b: buf.Bytes(), buf: buf})
+}
+
+// write queues msg unless the connection is closed. bufChan is never
+// closed, so writers racing with Close can't panic; they either get
+// ErrConnClosed or had their message queued before Close began.
+func (self *TcpConn) write(msg sendMsg) (int, error) {
 	if self.closed() {
-		return 0, errors.New("connection closed")
+		msg.release()
+		return 0, ErrConnClosed
 	}
 
-	cnt := len(b)
+	cnt := len(msg.b)
 	if cnt == 0 || cnt > SendBufLenMax {
+		msg.release()
 		return 0, errors.New("invalid data")
 	}
 
-	self.bufChan <- b
+	if err := self.enqueue(msg); err != nil {
+		return 0, err
+	}
+	// Close may have slipped in between the check above and enqueue. The
+	// send goroutine discards the queue once closed, but it may already
+	// have done so, so discard again lest msg is never released
+	if self.closed() {
+		self.discard()
+		return 0, ErrConnClosed
+	}
 	return cnt, nil
 }
 
+// WriteFrame encodes frame with the codec, if any, and queues it for sending.
+func (self *TcpConn) WriteFrame(frame []byte) (n int, err error) {
+	if self.owner.codec == nil {
+		return self.Write(frame)
+	}
+
+	if encoder, ok := self.owner.codec.(BufferEncoder); ok {
+		buf, err := encoder.EncodeBuffer(frame)
+		if err != nil {
+			return 0, err
+		}
+		if _, err = self.WriteBuffer(buf); err != nil {
+			return 0, err
+		}
+		return len(frame), nil
+	}
+
+	b, err := self.owner.codec.Encode(frame)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = self.Write(b); err != nil {
+		return 0, err
+	}
+	return len(frame), nil
+}
+
 func (self *TcpConn) Close() error {
+	self.closeWith(CloseLocal, nil)
+	return nil
+}
+
+// CloseReason returns why the connection was closed; it is only meaningful
+// once the connection is closed.
+func (self *TcpConn) CloseReason() CloseReason {
+	if !self.closed() {
+		return CloseLocal
+	}
+	return self.reason
+}
+
+// Err returns the error that caused the connection to close, such as
+// ErrReadIdle or a read error, or nil if it is still open or was closed
+// without one.
+func (self *TcpConn) Err() error {
+	if !self.closed() {
+		return nil
+	}
+	return self.closeErr
+}
+
+func (self *TcpConn) closeWith(reason CloseReason, err error) {
 	self.closeOnce.Do(func() {
+		self.reason = reason
+		self.closeErr = err
 		atomic.StoreInt32(&self.closedFlag, 1)
 		close(self.closeChan)
-		close(self.bufChan)
 		self.conn.Close()
+		if err != nil && self.owner.onError != nil {
+			self.owner.onError(self, err)
+		}
 		if self.onClose != nil {
-			self.onClose(self)
+			self.onClose(self, reason)
 		}
 		self.clear()
 	})
-	return nil
+}
+
+// drain makes the send goroutine flush whatever is queued and then close
+// the connection with CloseShutdown.
+func (self *TcpConn) drain() {
+	self.drainWith(CloseShutdown, nil)
+}
+
+// drainWith is drain with the close reason and a last, already encoded
+// frame written after the queue, bypassing its limits. Only the first call
+// has any effect.
+func (self *TcpConn) drainWith(reason CloseReason, farewell []byte) {
+	self.drainOnce.Do(func() {
+		self.drainWhy = reason
+		self.farewell = farewell
+		close(self.drainChan)
+	})
+}
+
+// kick drains the connection with CloseKicked, closing it anyway once
+// timeout has passed.
+func (self *TcpConn) kick(farewell []byte, timeout time.Duration) {
+	self.drainWith(CloseKicked, farewell)
+	time.AfterFunc(timeout, func() {
+		self.closeWith(CloseKicked, nil)
+	})
 }
 
 func (self *TcpConn) closed() bool {
@@ -82,6 +213,9 @@ func (self *TcpConn) RawConn() net.Conn {
 func (self *TcpConn) run() {
 	startGoroutine(self.send, self.owner.waitGroup)
 	startGoroutine(self.recv, self.owner.waitGroup)
+	if self.owner.watched() {
+		startGoroutine(self.watch, self.owner.waitGroup)
+	}
 }
 
 func startGoroutine(fn func(), wg *sync.WaitGroup) {
@@ -97,9 +231,16 @@ func (self *TcpConn) clear() {
 }
 
 func (self *TcpConn) send() {
+	batch := newSendBatch()
+	reason, err := CloseLocal, error(nil)
 	defer func() {
-		recover()
-		self.Close()
+		if r := recover(); r != nil {
+			reason = ClosePanic
+			err, _ = self.owner.recovered(self, r)
+		}
+		batch.reset()
+		self.closeWith(reason, err)
+		self.discard()
 	}()
 
 	for {
@@ -109,41 +250,185 @@ func (self *TcpConn) send() {
 
 		select {
 		case <-self.owner.exitChan:
+			reason = CloseShutdown
 			return
 		case <-self.closeChan:
 			return
-		case b := <-self.bufChan:
-			if n, err := self.conn.Write(b); err != nil || n != len(b) {
+		case msg := <-self.bufChan:
+			self.dequeued(msg)
+			batch.add(msg)
+			self.gather(batch, self.owner.writeWindow)
+			if err = self.writeBatch(batch); err != nil {
+				reason = CloseWriteError
 				return
 			}
+		case <-self.drainChan:
+			if err = self.flush(batch); err == nil && len(self.farewell) > 0 {
+				batch.add(sendMsg{b: self.farewell})
+				err = self.writeBatch(batch)
+			}
+			if err != nil {
+				reason = CloseWriteError
+				return
+			}
+			reason = self.drainWhy
+			return
+		}
+	}
+}
+
+// gather adds queued messages to batch until it holds batchSize bytes,
+// sendBatchMsgsMax messages or the queue runs dry. With a window > 0 it
+// waits up to that long for more messages before giving up.
+func (self *TcpConn) gather(batch *sendBatch, window time.Duration) {
+	var timeout <-chan time.Time
+	for batch.size < self.owner.batchSize() && len(batch.bufs) < sendBatchMsgsMax {
+		var msg sendMsg
+		select {
+		case msg = <-self.bufChan:
+		default:
+			if window <= 0 {
+				return
+			}
+			if timeout == nil {
+				timer := time.NewTimer(window)
+				defer timer.Stop()
+				timeout = timer.C
+			}
+			select {
+			case msg = <-self.bufChan:
+			case <-timeout:
+				return
+			case <-self.closeChan:
+				return
+			}
+		}
+		self.dequeued(msg)
+		batch.add(msg)
+	}
+}
+
+func (self *TcpConn) writeBatch(batch *sendBatch) error {
+	size, msgs := batch.size, len(batch.bufs)
+	err := batch.writeTo(self.conn)
+	batch.reset()
+	if err == nil {
+		atomic.StoreInt64(&self.lastWrite, time.Now().UnixNano())
+		self.countOut(size, msgs)
+	}
+	return err
+}
+
+func (self *TcpConn) flush(batch *sendBatch) error {
+	for {
+		self.gather(batch, 0)
+		if len(batch.bufs) == 0 {
+			return nil
+		}
+		if err := self.writeBatch(batch); err != nil {
+			return err
 		}
 	}
 }
 
 func (self *TcpConn) recv() {
+	reason, err := CloseLocal, error(nil)
 	defer func() {
-		recover()
-		self.Close()
+		if r := recover(); r != nil {
+			reason = ClosePanic
+			err, _ = self.owner.recovered(self, r)
+		}
+		self.closeWith(reason, err)
 	}()
 
-	buf := make([]byte, RecvBufLenMax)
+	rbuf := GetBuffer(RecvBufLenMax)
+	defer rbuf.Release()
+	buf := rbuf.Bytes()
+	pos := 0
 	for {
 		select {
 		case <-self.owner.exitChan:
+			reason = CloseShutdown
 			return
 		case <-self.closeChan:
 			return
 		default:
 		}
 
-		cnt, err := self.conn.Read(buf)
-		if err != nil || cnt == 0 {
+		var cnt int
+		if cnt, err = self.conn.Read(buf[pos:]); err != nil || cnt == 0 {
+			if reason = readCloseReason(err); reason == ClosePeerEOF {
+				err = nil
+			}
 			return
 		}
-		if self.onRead != nil {
-			if n, err := self.onRead(buf[:cnt]); n != cnt || err != nil {
+		atomic.StoreInt64(&self.lastRead, time.Now().UnixNano())
+		self.countIn(cnt, 0)
+		if self.owner.codec == nil {
+			if err = self.dispatch(buf[:cnt]); err != nil {
+				reason = dispatchCloseReason(err)
 				return
 			}
+			continue
 		}
+
+		if pos, err = self.unpack(buf[:pos+cnt]); err != nil {
+			reason = dispatchCloseReason(err)
+			return
+		}
+		if pos == len(buf) {
+			reason, err = CloseReadError, ErrFrameTooLarge
+			return
+		}
+	}
+}
+
+// unpack hands every whole frame in b to the session and moves the trailing
+// partial frame to the front of b, returning its length.
+func (self *TcpConn) unpack(b []byte) (int, error) {
+	offset := 0
+	for offset < len(b) {
+		frame, n, err := self.owner.codec.Decode(b[offset:])
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			break
+		}
+		offset += n
+		if err := self.dispatch(frame); err != nil {
+			return 0, err
+		}
+	}
+	return copy(b, b[offset:]), nil
+}
+
+func (self *TcpConn) dispatch(b []byte) (err error) {
+	self.countIn(0, 1)
+	if self.onRead == nil {
+		return nil
+	}
+	if self.owner.onHandled != nil {
+		defer self.owner.handled(self, time.Now())
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			if panicErr, policy := self.owner.recovered(self, r); policy != PanicContinue {
+				err = panicErr
+			}
+		}
+	}()
+
+	n, err := self.onRead(b)
+	if err == nil && n != len(b) {
+		err = ErrInvalidFrame
+	}
+	return err
+}
+
+func dispatchCloseReason(err error) CloseReason {
+	if isPanicError(err) {
+		return ClosePanic
 	}
+	return CloseReadError
 }
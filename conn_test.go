@@ -0,0 +1,168 @@
+// Copyright (C) 2018 ecofast(胡光耀). All rights reserved.
+// Use of this source code is governed by a BSD-style license.
+
+package tcpsock
+
+import (
+	"flag"
+	"io"
+	"math/rand"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var (
+	stressConns   = flag.Int("stress.conns", 50, "num of connections in TestStress")
+	stressWriters = flag.Int("stress.writers", 2000, "num of concurrent writers in TestStress")
+	stressTime    = flag.Duration("stress.time", time.Second, "duration of TestStress")
+)
+
+// TestStress hammers TcpConn with concurrent writers and closers and is
+// meant to be run with the race detector, e.g.
+//
+//	go test -race -run=Stress -stress.time=10s
+//
+// It fails if a write panics, if a write issued after Close has returned
+// succeeds, if a buffer passed to WriteBuffer is never released or if
+// goroutines are left behind once the server is closed.
+func TestStress(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipped in short mode")
+	}
+
+	baseline := runtime.NumGoroutine()
+	connNum, writerNum, duration := *stressConns, *stressWriters, *stressTime
+
+	var mutex sync.Mutex
+	conns := make([]*TcpConn, 0, connNum)
+	svr := NewTcpServer("127.0.0.1:0", func(conn *TcpConn) TcpSession {
+		mutex.Lock()
+		conns = append(conns, conn)
+		mutex.Unlock()
+		return nil
+	}, func(conn *TcpConn, reason CloseReason) {}, nil)
+	svr.SetSendQueue(SendBlock, 8, 0, 10*time.Millisecond)
+	svr.Serve()
+
+	peers := make([]net.Conn, 0, connNum)
+	for i := 0; i < connNum; i++ {
+		peer, err := net.Dial("tcp", svr.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		// half of the peers never read, so their send queues fill up and
+		// writers pile up waiting for room when Close comes along
+		if i%2 == 0 {
+			go io.Copy(io.Discard, peer)
+		}
+		peers = append(peers, peer)
+	}
+	for {
+		mutex.Lock()
+		ready := len(conns) == connNum
+		mutex.Unlock()
+		if ready {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var writes, closedWrites int64
+	var closedAt sync.Map
+	leases := make([][]*Buffer, writerNum)
+	exitChan := make(chan struct{})
+	waitGroup := &sync.WaitGroup{}
+	payload := make([]byte, 4*1024)
+
+	for i := 0; i < writerNum; i++ {
+		waitGroup.Add(1)
+		go func(i int) {
+			defer waitGroup.Done()
+			for {
+				select {
+				case <-exitChan:
+					return
+				default:
+				}
+
+				conn := conns[rand.Intn(len(conns))]
+				_, wasClosed := closedAt.Load(conn)
+				var err error
+				if i%2 == 0 {
+					_, err = conn.Write(payload)
+				} else {
+					// an unpooled buffer keeps its count once released, so
+					// it can be checked in the end
+					buf := &Buffer{data: payload, class: -1, refs: 1}
+					if _, err = conn.WriteBuffer(buf); err == nil {
+						leases[i] = append(leases[i], buf)
+					} else if atomic.LoadInt32(&buf.refs) != 0 {
+						t.Errorf("WriteBuffer returned %v without releasing the buffer", err)
+					}
+				}
+				atomic.AddInt64(&writes, 1)
+				if wasClosed {
+					atomic.AddInt64(&closedWrites, 1)
+					if err != ErrConnClosed {
+						t.Errorf("write after Close returned %v", err)
+					}
+				}
+			}
+		}(i)
+	}
+
+	// closers race with the writers and each other
+	for i := 0; i < 4; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for _, idx := range rand.Perm(len(conns)) {
+				select {
+				case <-exitChan:
+					return
+				case <-time.After(duration / time.Duration(len(conns))):
+				}
+				conns[idx].Close()
+				closedAt.Store(conns[idx], time.Now())
+			}
+		}()
+	}
+
+	time.Sleep(duration)
+	close(exitChan)
+	waitGroup.Wait()
+	svr.Close()
+	for _, peer := range peers {
+		peer.Close()
+	}
+	t.Logf("%d writes, %d of them after Close", writes, closedWrites)
+
+	unreleased := 0
+	for _, bufs := range leases {
+		for _, buf := range bufs {
+			if atomic.LoadInt32(&buf.refs) != 0 {
+				unreleased++
+			}
+		}
+	}
+	if unreleased > 0 {
+		t.Errorf("%d buffers passed to WriteBuffer were never released", unreleased)
+	}
+
+	// give the runtime a moment to reap exited goroutines
+	leaked := 0
+	for i := 0; i < 50; i++ {
+		if leaked = runtime.NumGoroutine() - baseline; leaked <= 0 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if leaked > 0 {
+		buf := make([]byte, 1<<20)
+		t.Errorf("%d goroutines leaked\n%s", leaked, buf[:runtime.Stack(buf, true)])
+	}
+}
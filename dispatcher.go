@@ -0,0 +1,170 @@
+// Copyright (C) 2018 ecofast(胡光耀). All rights reserved.
+// Use of this source code is governed by a BSD-style license.
+
+package tcpsock
+
+import (
+	"errors"
+	"runtime"
+	"runtime/debug"
+	"sync"
+)
+
+const (
+	dispatchQueueLenDef = 256
+)
+
+var (
+	ErrDispatcherFull   = errors.New("dispatcher queue full")
+	ErrDispatcherClosed = errors.New("dispatcher closed")
+)
+
+type OnTaskOverload = func(key uint64)
+type OnTaskPanic = func(key uint64, v interface{}, stack []byte)
+type OnMsgKey = func(session TcpSession, msg Message) uint64
+
+// Dispatcher runs tasks on a fixed pool of workers. Tasks submitted with
+// the same key always land on the same worker and so run one at a time,
+// in the order they were submitted; tasks with different keys run in
+// parallel, spread over all workers.
+type Dispatcher struct {
+	queues     []chan dispatchTask
+	waitGroup  sync.WaitGroup
+	mutex      sync.RWMutex
+	closed     bool
+	onOverload OnTaskOverload
+	onPanic    OnTaskPanic
+}
+
+type dispatchTask struct {
+	key uint64
+	fn  func()
+}
+
+// NewDispatcher starts workers goroutines (runtime.NumCPU() if <= 0), each
+// with a queue of up to queueLen tasks (256 if <= 0).
+func NewDispatcher(workers, queueLen int) *Dispatcher {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if queueLen <= 0 {
+		queueLen = dispatchQueueLenDef
+	}
+
+	d := &Dispatcher{
+		queues: make([]chan dispatchTask, workers),
+	}
+	for i := range d.queues {
+		d.queues[i] = make(chan dispatchTask, queueLen)
+		d.waitGroup.Add(1)
+		go d.work(d.queues[i])
+	}
+	return d
+}
+
+// SetOverloadHandler installs onOverload, which is told the key of every
+// task turned away because its worker's queue is full. It must be called
+// before the first Submit.
+func (self *Dispatcher) SetOverloadHandler(onOverload OnTaskOverload) {
+	self.onOverload = onOverload
+}
+
+// SetPanicHandler installs onPanic for panics raised by tasks. Either way
+// the worker carries on with the next task. It must be called before the
+// first Submit.
+func (self *Dispatcher) SetPanicHandler(onPanic OnTaskPanic) {
+	self.onPanic = onPanic
+}
+
+// Submit queues fn to run after every task submitted earlier with the same
+// key. It never blocks: if the queue is full fn is dropped and
+// ErrDispatcherFull returned.
+func (self *Dispatcher) Submit(key uint64, fn func()) error {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	if self.closed {
+		return ErrDispatcherClosed
+	}
+
+	select {
+	case self.queue(key) <- dispatchTask{key: key, fn: fn}:
+		return nil
+	default:
+	}
+	if self.onOverload != nil {
+		self.onOverload(key)
+	}
+	return ErrDispatcherFull
+}
+
+// Pending returns the number of queued tasks.
+func (self *Dispatcher) Pending() int {
+	n := 0
+	for _, queue := range self.queues {
+		n += len(queue)
+	}
+	return n
+}
+
+// Close stops taking tasks, runs the ones already queued and waits for
+// the workers to finish.
+func (self *Dispatcher) Close() {
+	self.mutex.Lock()
+	if !self.closed {
+		self.closed = true
+		for _, queue := range self.queues {
+			close(queue)
+		}
+	}
+	self.mutex.Unlock()
+	self.waitGroup.Wait()
+}
+
+// Async is a Router middleware that hands the rest of the chain over to
+// the dispatcher, keyed by key or, if key is nil, by the session's
+// SockHandle. The message is copied first, as it doesn't outlive Read. A
+// handler error closes the session; a Submit error is returned and so
+// closes the connection as well.
+func (self *Dispatcher) Async(key OnMsgKey) Middleware {
+	return func(next MsgHandler) MsgHandler {
+		return func(session TcpSession, msg Message) error {
+			k := session.SockHandle()
+			if key != nil {
+				k = key(session, msg)
+			}
+
+			buf := make([]byte, len(msg.Frame)+len(msg.Body))
+			frame := buf[:copy(buf, msg.Frame)]
+			body := buf[len(frame):]
+			copy(body, msg.Body)
+			return self.Submit(k, func() {
+				if err := next(session, Message{ID: msg.ID, Body: body, Frame: frame}); err != nil {
+					session.Close()
+				}
+			})
+		}
+	}
+}
+
+func (self *Dispatcher) queue(key uint64) chan dispatchTask {
+	// mix the bits so that sequential keys, such as connection IDs, spread
+	// evenly whatever the number of workers
+	h := (key * 0x9E3779B97F4A7C15) >> 32
+	return self.queues[h%uint64(len(self.queues))]
+}
+
+func (self *Dispatcher) work(queue chan dispatchTask) {
+	defer self.waitGroup.Done()
+	for task := range queue {
+		self.run(task)
+	}
+}
+
+func (self *Dispatcher) run(task dispatchTask) {
+	defer func() {
+		if r := recover(); r != nil && self.onPanic != nil {
+			self.onPanic(task.key, r, debug.Stack())
+		}
+	}()
+	task.fn()
+}
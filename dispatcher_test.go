@@ -0,0 +1,133 @@
+// Copyright (C) 2018 ecofast(胡光耀). All rights reserved.
+// Use of this source code is governed by a BSD-style license.
+
+package tcpsock
+
+import (
+	"sync"
+	"testing"
+)
+
+// TestDispatcherOrder checks that tasks with the same key run in the order
+// they were submitted, whatever the number of workers.
+func TestDispatcherOrder(t *testing.T) {
+	const keys, tasks = 50, 200
+	for _, workers := range []int{1, 3, 8} {
+		d := NewDispatcher(workers, keys*tasks)
+		var mutex sync.Mutex
+		done := make(map[uint64][]int, keys)
+		for i := 0; i < tasks; i++ {
+			for key := uint64(0); key < keys; key++ {
+				key, i := key, i
+				if err := d.Submit(key, func() {
+					mutex.Lock()
+					done[key] = append(done[key], i)
+					mutex.Unlock()
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		d.Close()
+
+		for key := uint64(0); key < keys; key++ {
+			if len(done[key]) != tasks {
+				t.Fatalf("%d workers, key %d: %d tasks ran, want %d", workers, key, len(done[key]), tasks)
+			}
+			for i, n := range done[key] {
+				if n != i {
+					t.Fatalf("%d workers, key %d: task %d ran in place %d", workers, key, n, i)
+				}
+			}
+		}
+	}
+}
+
+func TestDispatcherOverload(t *testing.T) {
+	const queueLen = 4
+	d := NewDispatcher(1, queueLen)
+	var overloaded []uint64
+	d.SetOverloadHandler(func(key uint64) {
+		overloaded = append(overloaded, key)
+	})
+
+	// the worker takes the first task and is held in it, so the queue fills
+	// up after queueLen more
+	started, release := make(chan struct{}), make(chan struct{})
+	d.Submit(0, func() {
+		close(started)
+		<-release
+	})
+	<-started
+	cases := []struct {
+		key uint64
+		err error
+	}{
+		{1, nil}, {2, nil}, {3, nil}, {4, nil},
+		{5, ErrDispatcherFull},
+		{6, ErrDispatcherFull},
+	}
+	for _, c := range cases {
+		if err := d.Submit(c.key, func() {}); err != c.err {
+			t.Errorf("key %d: got %v, want %v", c.key, err, c.err)
+		}
+	}
+	if d.Pending() != queueLen {
+		t.Errorf("%d tasks pending, want %d", d.Pending(), queueLen)
+	}
+	if len(overloaded) != 2 || overloaded[0] != 5 || overloaded[1] != 6 {
+		t.Errorf("overload handler got %v, want [5 6]", overloaded)
+	}
+
+	close(release)
+	d.Close()
+	if d.Pending() != 0 {
+		t.Errorf("%d tasks still pending after Close", d.Pending())
+	}
+	if err := d.Submit(7, func() {}); err != ErrDispatcherClosed {
+		t.Errorf("after Close: got %v, want %v", err, ErrDispatcherClosed)
+	}
+}
+
+// TestDispatcherPanic checks that a worker carries on after a task panics.
+func TestDispatcherPanic(t *testing.T) {
+	d := NewDispatcher(1, 0)
+	var panicked interface{}
+	d.SetPanicHandler(func(key uint64, v interface{}, stack []byte) {
+		panicked = v
+	})
+	ran := false
+	d.Submit(1, func() {
+		panic("boom")
+	})
+	d.Submit(1, func() {
+		ran = true
+	})
+	d.Close()
+	if panicked != "boom" || !ran {
+		t.Errorf("panic handler got %v, next task ran: %v", panicked, ran)
+	}
+}
+
+// TestDispatcherAsync checks that the message reaches the handler intact
+// even though the caller reuses its frame as soon as Dispatch returns.
+func TestDispatcherAsync(t *testing.T) {
+	d := NewDispatcher(2, 0)
+	var got []string
+	r := NewRouter(NewIDParser(0, 1, nil))
+	r.Handle(1, func(session TcpSession, msg Message) error {
+		got = append(got, string(msg.Frame)+"/"+string(msg.Body))
+		return nil
+	}).Use(d.Async(nil))
+
+	frame := []byte("\x01hello")
+	r.Dispatch(idSession(1), frame)
+	copy(frame, "\x01jelly")
+	r.Dispatch(idSession(1), frame)
+	d.Close()
+
+	want := []string{"\x01hello/hello", "\x01jelly/jelly"}
+	if len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
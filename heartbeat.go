@@ -0,0 +1,125 @@
+// Copyright (C) 2018 ecofast(胡光耀). All rights reserved.
+// Use of this source code is governed by a BSD-style license.
+
+package tcpsock
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	idleCheckIntvMin = 50 * time.Millisecond
+)
+
+var (
+	ErrReadIdle    = errors.New("read idle timeout")
+	ErrWriteIdle   = errors.New("write idle timeout")
+	ErrIdleTimeout = errors.New("idle timeout")
+)
+
+// SetIdleTimeout closes connections that have received nothing for read,
+// sent nothing for write, or done neither for total. Zero disables the
+// respective check. It must be called before serving or opening.
+func (self *tcpSock) SetIdleTimeout(read, write, total time.Duration) {
+	self.readIdle = read
+	self.writeIdle = write
+	self.totalIdle = total
+}
+
+// SetHeartbeat makes every connection that has sent nothing for intv write
+// the frame returned by onPing; a nil frame skips that beat. The frame goes
+// out as is, so it must already be encoded. It must be called before
+// serving or opening.
+func (self *tcpSock) SetHeartbeat(intv time.Duration, onPing OnTcpPing) {
+	if intv <= 0 || onPing == nil {
+		intv, onPing = 0, nil
+	}
+	self.pingIntv = intv
+	self.onPing = onPing
+}
+
+func (self *tcpSock) watched() bool {
+	return self.readIdle > 0 || self.writeIdle > 0 || self.totalIdle > 0 || self.onPing != nil
+}
+
+// checkIntv is half the shortest configured period, so a timeout fires at
+// most 50% late.
+func (self *tcpSock) checkIntv() time.Duration {
+	intv := time.Duration(0)
+	for _, d := range []time.Duration{self.readIdle, self.writeIdle, self.totalIdle, self.pingIntv} {
+		if d > 0 && (intv == 0 || d < intv) {
+			intv = d
+		}
+	}
+	if intv /= 2; intv < idleCheckIntvMin {
+		intv = idleCheckIntvMin
+	}
+	return intv
+}
+
+func (self *TcpConn) watch() {
+	ticker := time.NewTicker(self.owner.checkIntv())
+	defer func() {
+		if r := recover(); r != nil {
+			err, _ := self.owner.recovered(self, r)
+			self.closeWith(ClosePanic, err)
+		}
+		ticker.Stop()
+	}()
+
+	for {
+		select {
+		case <-self.owner.exitChan:
+			return
+		case <-self.closeChan:
+			return
+		case now := <-ticker.C:
+			if err := self.checkIdle(now); err != nil {
+				if isPanicError(err) {
+					self.closeWith(ClosePanic, err)
+				} else {
+					self.closeWith(CloseIdleTimeout, err)
+				}
+				return
+			}
+		}
+	}
+}
+
+func (self *TcpConn) checkIdle(now time.Time) error {
+	readIdle := now.Sub(time.Unix(0, atomic.LoadInt64(&self.lastRead)))
+	writeIdle := now.Sub(time.Unix(0, atomic.LoadInt64(&self.lastWrite)))
+	if self.owner.readIdle > 0 && readIdle >= self.owner.readIdle {
+		return ErrReadIdle
+	}
+	if self.owner.writeIdle > 0 && writeIdle >= self.owner.writeIdle {
+		return ErrWriteIdle
+	}
+	if self.owner.totalIdle > 0 && readIdle >= self.owner.totalIdle && writeIdle >= self.owner.totalIdle {
+		return ErrIdleTimeout
+	}
+
+	if self.owner.onPing != nil && writeIdle >= self.owner.pingIntv {
+		return self.ping()
+	}
+	return nil
+}
+
+func (self *TcpConn) ping() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if panicErr, policy := self.owner.recovered(self, r); policy != PanicContinue {
+				err = panicErr
+			}
+		}
+	}()
+
+	// a full queue means the peer isn't reading; skip the beat rather than
+	// block, and with it the idle checks that are to catch such a peer
+	if b := self.owner.onPing(self); len(b) > 0 && !self.closed() {
+		self.tryEnqueue(sendMsg{b: b})
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+// Copyright (C) 2018 ecofast(胡光耀). All rights reserved.
+// Use of this source code is governed by a BSD-style license.
+
+package tcpsock
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// TestHeartbeatStuckPeer checks that a peer that stops reading, so that
+// the send queue fills up, is still closed by the idle timeout while the
+// heartbeat keeps trying to ping it.
+func TestHeartbeatStuckPeer(t *testing.T) {
+	for _, heartbeat := range []bool{false, true} {
+		reasons := make(chan CloseReason, 1)
+		svr := NewTcpServer("127.0.0.1:0", func(conn *TcpConn) TcpSession {
+			go func() {
+				chunk := make([]byte, 16*1024)
+				for {
+					if _, err := conn.Write(chunk); err != nil {
+						return
+					}
+				}
+			}()
+			return nil
+		}, func(conn *TcpConn, reason CloseReason) {
+			reasons <- reason
+		}, nil)
+		svr.SetSendQueue(SendBlock, 2, 0, 0)
+		svr.SetIdleTimeout(500*time.Millisecond, 0, 0)
+		if heartbeat {
+			svr.SetHeartbeat(50*time.Millisecond, func(conn *TcpConn) []byte {
+				return []byte("ping")
+			})
+		}
+		svr.Serve()
+
+		peer, err := net.Dial("tcp", svr.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case reason := <-reasons:
+			if reason != CloseIdleTimeout {
+				t.Errorf("heartbeat %v: closed with %v, want %v", heartbeat, reason, CloseIdleTimeout)
+			}
+		case <-time.After(3 * time.Second):
+			t.Errorf("heartbeat %v: a peer that doesn't read was still open after 3s", heartbeat)
+		}
+		peer.Close()
+		svr.Close()
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright (C) 2018 ecofast(胡光耀). All rights reserved.
+// Use of this source code is governed by a BSD-style license.
+
+package tcpsock
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// IPFilter decides which IPs may connect from lists of CIDR ranges, IPv4
+// and IPv6 alike. An IP in the deny list is always refused; if the allow
+// list isn't empty, only IPs in it are let in. Lookups are a binary search
+// over merged ranges, so lists of thousands of entries cost next to
+// nothing. An IPFilter never changes once built.
+type IPFilter struct {
+	allow ipRanges
+	deny  ipRanges
+}
+
+// NewIPFilter builds a filter from CIDRs such as "10.0.0.0/8" or
+// "2001:db8::/32"; a plain IP stands for itself alone.
+func NewIPFilter(allow, deny []string) (*IPFilter, error) {
+	filter := &IPFilter{}
+	for _, s := range allow {
+		if err := filter.allow.add(s); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range deny {
+		if err := filter.deny.add(s); err != nil {
+			return nil, err
+		}
+	}
+	filter.allow.merge()
+	filter.deny.merge()
+	return filter, nil
+}
+
+// LoadIPFilter reads a filter from path, which holds one "allow <cidr>"
+// or "deny <cidr>" per line. Blank lines and lines starting with # are
+// skipped.
+func LoadIPFilter(path string) (*IPFilter, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var allow, deny []string
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want \"allow|deny <cidr>\"", path, n)
+		}
+		switch strings.ToLower(fields[0]) {
+		case "allow":
+			allow = append(allow, fields[1])
+		case "deny":
+			deny = append(deny, fields[1])
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown action %q", path, n, fields[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	filter, err := NewIPFilter(allow, deny)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return filter, nil
+}
+
+func (self *IPFilter) Allowed(ip net.IP) bool {
+	key, ok := toIPKey(ip)
+	if !ok {
+		return false
+	}
+	if self.deny.contains(key) {
+		return false
+	}
+	return len(self.allow) == 0 || self.allow.contains(key)
+}
+
+// SetIPFilter makes the server refuse connections filter doesn't allow,
+// before onCheckIP is consulted; nil removes the filter. It may be called
+// at any time, e.g. to swap in a freshly loaded filter, and takes effect
+// from the next accepted connection on.
+func (self *TcpServer) SetIPFilter(filter *IPFilter) {
+	self.ipFilter.Store(ipFilterBox{filter})
+}
+
+// filterIP lets addr through if there is no filter, if the filter allows
+// it or if it has no IP at all, as with Unix domain sockets.
+func (self *TcpServer) filterIP(addr net.Addr) bool {
+	box, _ := self.ipFilter.Load().(ipFilterBox)
+	if box.filter == nil {
+		return true
+	}
+	ip := addrIP(addr)
+	return ip == "" || box.filter.Allowed(net.ParseIP(ip))
+}
+
+// ipFilterBox lets a nil filter be stored in an atomic.Value.
+type ipFilterBox struct {
+	filter *IPFilter
+}
+
+// ipKey128 is an IP as a 128 bit number, IPv4 in its IPv4-mapped IPv6 form.
+type ipKey128 struct {
+	hi, lo uint64
+}
+
+func (self ipKey128) less(other ipKey128) bool {
+	return self.hi < other.hi || (self.hi == other.hi && self.lo < other.lo)
+}
+
+// next returns self+1, wrapping around at the top.
+func (self ipKey128) next() ipKey128 {
+	if self.lo++; self.lo == 0 {
+		self.hi++
+	}
+	return self
+}
+
+func toIPKey(ip net.IP) (ipKey128, bool) {
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return ipKey128{}, false
+	}
+	return ipKey128{binary.BigEndian.Uint64(ip16[:8]), binary.BigEndian.Uint64(ip16[8:])}, true
+}
+
+type ipRange struct {
+	first, last ipKey128
+}
+
+type ipRanges []ipRange
+
+func (self *ipRanges) add(s string) error {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return fmt.Errorf("invalid ip %q", s)
+		}
+		key, _ := toIPKey(ip)
+		*self = append(*self, ipRange{key, key})
+		return nil
+	}
+
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		return err
+	}
+	first, _ := toIPKey(ipNet.IP)
+	last := make(net.IP, len(ipNet.IP))
+	for i := range ipNet.IP {
+		last[i] = ipNet.IP[i] | ^ipNet.Mask[i]
+	}
+	lastKey, _ := toIPKey(last)
+	*self = append(*self, ipRange{first, lastKey})
+	return nil
+}
+
+// merge sorts the ranges and joins overlapping or adjacent ones, so that
+// contains can binary search them.
+func (self *ipRanges) merge() {
+	ranges := *self
+	if len(ranges) == 0 {
+		return
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].first.less(ranges[j].first)
+	})
+
+	merged := ranges[:1]
+	for _, r := range ranges[1:] {
+		top := &merged[len(merged)-1]
+		if end := top.last.next(); r.first.less(end) || r.first == end || top.last == (ipKey128{^uint64(0), ^uint64(0)}) {
+			if top.last.less(r.last) {
+				top.last = r.last
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	*self = merged
+}
+
+func (self ipRanges) contains(key ipKey128) bool {
+	// the first range starting after key; the one before it is the only
+	// candidate
+	i := sort.Search(len(self), func(i int) bool {
+		return key.less(self[i].first)
+	})
+	return i > 0 && !self[i-1].last.less(key)
+}
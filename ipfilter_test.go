@@ -0,0 +1,94 @@
+// Copyright (C) 2018 ecofast(胡光耀). All rights reserved.
+// Use of this source code is governed by a BSD-style license.
+
+package tcpsock
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIPRanges(t *testing.T) {
+	var ranges ipRanges
+	for _, s := range []string{
+		"10.0.0.0/24",
+		"10.0.1.0/24", // adjacent to the one above
+		"10.0.0.128/25",
+		"192.168.1.7",
+		"2001:db8::/32",
+		"::ffff:0:0/96", // overlaps every IPv4 range above
+		"172.16.0.0/12",
+	} {
+		if err := ranges.add(s); err != nil {
+			t.Fatalf("add(%q): %v", s, err)
+		}
+	}
+	for _, s := range []string{"10.0.0.0/33", "10.0.0.300", "bogus"} {
+		if err := ranges.add(s); err == nil {
+			t.Fatalf("add(%q) accepted", s)
+		}
+	}
+
+	ranges.merge()
+	if len(ranges) != 2 {
+		t.Fatalf("merge left %d ranges, want 2: %v", len(ranges), ranges)
+	}
+	for i := 1; i < len(ranges); i++ {
+		if !ranges[i-1].last.less(ranges[i].first) {
+			t.Fatalf("ranges %d and %d overlap after merge", i-1, i)
+		}
+	}
+
+	ranges = nil
+	for _, s := range []string{"10.0.0.0/24", "10.0.1.0/24", "10.0.3.0/24", "192.168.1.7", "2001:db8::/32", "0.0.0.0/32"} {
+		ranges.add(s)
+	}
+	ranges.merge()
+	if len(ranges) != 5 {
+		t.Fatalf("merge left %d ranges, want 5", len(ranges))
+	}
+	cases := map[string]bool{
+		"10.0.0.0":        true,
+		"10.0.1.255":      true,
+		"10.0.2.0":        false,
+		"10.0.3.77":       true,
+		"10.0.4.0":        false,
+		"9.255.255.255":   false,
+		"0.0.0.0":         true,
+		"0.0.0.1":         false,
+		"192.168.1.7":     true,
+		"192.168.1.8":     false,
+		"::ffff:10.0.0.1": true,
+		"2001:db8::1":     true,
+		"2001:db9::":      false,
+		"::":              false,
+		"ffff::":          false,
+	}
+	for s, want := range cases {
+		key, _ := toIPKey(net.ParseIP(s))
+		if got := ranges.contains(key); got != want {
+			t.Errorf("contains(%s) = %v, want %v", s, got, want)
+		}
+	}
+
+	var empty ipRanges
+	empty.merge()
+	if key, _ := toIPKey(net.ParseIP("1.2.3.4")); empty.contains(key) {
+		t.Error("empty ranges contain 1.2.3.4")
+	}
+}
+
+func TestIPRangesMergeTop(t *testing.T) {
+	var ranges ipRanges
+	ranges.add("ffff::/16")
+	ranges.add("ffff:ffff::/32")
+	ranges.add("::/128")
+	ranges.merge()
+	if len(ranges) != 2 {
+		t.Fatalf("merge left %d ranges, want 2", len(ranges))
+	}
+	key, _ := toIPKey(net.ParseIP("ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"))
+	if !ranges.contains(key) {
+		t.Error("the last address is not contained")
+	}
+}
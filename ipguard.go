@@ -0,0 +1,257 @@
+// Copyright (C) 2018 ecofast(胡光耀). All rights reserved.
+// Use of this source code is governed by a BSD-style license.
+
+package tcpsock
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidIP = errors.New("invalid ip")
+)
+
+// IPLimits caps what a single IP address may do. Zero values disable the
+// respective limit.
+type IPLimits struct {
+	// MaxConns caps the connections open from one IP at once.
+	MaxConns int
+	// Rate and Burst limit how many connections per second one IP may
+	// open, allowing bursts of up to Burst (at least 1).
+	Rate  float64
+	Burst int
+	// BanTime is how long an IP is banned after its first offence, i.e.
+	// exceeding MaxConns or Rate. Every further offence doubles it, up to
+	// BanMax. Offences are forgiven once the IP has gone BanMax past the
+	// end of its ban without a new one.
+	BanTime time.Duration
+	BanMax  time.Duration
+}
+
+// BanEntry describes one banned IP.
+type BanEntry struct {
+	IP       string
+	Until    time.Time
+	Offences int
+}
+
+// ipGuard keeps per IP connection counts, connect rates and bans.
+type ipGuard struct {
+	mutex     sync.Mutex
+	limits    IPLimits
+	ips       map[string]*ipState
+	lastSweep time.Time
+}
+
+type ipState struct {
+	conns       int
+	tokens      float64
+	last        time.Time
+	offences    int
+	bannedUntil time.Time
+}
+
+func newIPGuard() *ipGuard {
+	return &ipGuard{
+		ips:       make(map[string]*ipState),
+		lastSweep: time.Now(),
+	}
+}
+
+// SetIPLimits applies limits to every IP; connections already open count
+// towards MaxConns. It may be called at any time.
+func (self *TcpServer) SetIPLimits(limits IPLimits) {
+	if limits.Burst < 1 {
+		limits.Burst = 1
+	}
+	if limits.BanMax < limits.BanTime {
+		limits.BanMax = limits.BanTime
+	}
+
+	self.ipGuard.mutex.Lock()
+	self.ipGuard.limits = limits
+	self.ipGuard.mutex.Unlock()
+}
+
+// Ban refuses connections from ip for d, replacing any current ban. It
+// doesn't touch connections already open; see KickWhere for those.
+func (self *TcpServer) Ban(ip string, d time.Duration) error {
+	key, err := ipKey(ip)
+	if err != nil {
+		return err
+	}
+
+	guard := self.ipGuard
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+	guard.state(key, time.Now()).bannedUntil = time.Now().Add(d)
+	return nil
+}
+
+// Unban lifts the ban on ip and forgives its offences. It reports whether
+// ip was banned.
+func (self *TcpServer) Unban(ip string) bool {
+	key, err := ipKey(ip)
+	if err != nil {
+		return false
+	}
+
+	guard := self.ipGuard
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+	state, ok := guard.ips[key]
+	if !ok {
+		return false
+	}
+	banned := state.bannedUntil.After(time.Now())
+	state.bannedUntil = time.Time{}
+	state.offences = 0
+	return banned
+}
+
+// Bans lists the IPs banned right now, soonest to expire first.
+func (self *TcpServer) Bans() []BanEntry {
+	guard := self.ipGuard
+	now := time.Now()
+	guard.mutex.Lock()
+	bans := make([]BanEntry, 0)
+	for ip, state := range guard.ips {
+		if state.bannedUntil.After(now) {
+			bans = append(bans, BanEntry{IP: ip, Until: state.bannedUntil, Offences: state.offences})
+		}
+	}
+	guard.mutex.Unlock()
+
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Until.Before(bans[j].Until)
+	})
+	return bans
+}
+
+// admit counts a new connection from ip in, unless it is banned or over
+// its limits, which counts as an offence.
+func (self *ipGuard) admit(ip string, now time.Time) (RejectReason, bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.sweep(now)
+	state := self.state(ip, now)
+	if state.bannedUntil.After(now) {
+		return RejectBanned, false
+	}
+
+	limits := &self.limits
+	if limits.Rate > 0 {
+		if state.tokens += now.Sub(state.last).Seconds() * limits.Rate; state.tokens > float64(limits.Burst) {
+			state.tokens = float64(limits.Burst)
+		}
+		state.last = now
+		if state.tokens < 1 {
+			self.offend(state, now)
+			return RejectIPRate, false
+		}
+	}
+	if limits.MaxConns > 0 && state.conns >= limits.MaxConns {
+		self.offend(state, now)
+		return RejectIPLimit, false
+	}
+
+	if limits.Rate > 0 {
+		state.tokens--
+	}
+	state.conns++
+	return 0, true
+}
+
+func (self *ipGuard) release(ip string) {
+	self.mutex.Lock()
+	if state, ok := self.ips[ip]; ok && state.conns > 0 {
+		state.conns--
+	}
+	self.mutex.Unlock()
+}
+
+func (self *ipGuard) state(ip string, now time.Time) *ipState {
+	state, ok := self.ips[ip]
+	if !ok {
+		state = &ipState{tokens: float64(self.limits.Burst), last: now}
+		self.ips[ip] = state
+	}
+	return state
+}
+
+func (self *ipGuard) offend(state *ipState, now time.Time) {
+	if self.limits.BanTime <= 0 {
+		return
+	}
+	// measured from the end of the ban, so an IP that offends again as
+	// soon as it is let back in keeps the longest ban
+	if now.Sub(state.bannedUntil) >= self.limits.BanMax {
+		state.offences = 0
+	}
+	state.offences++
+
+	d := self.limits.BanTime
+	for i := 1; i < state.offences && d < self.limits.BanMax; i++ {
+		d *= 2
+	}
+	if d > self.limits.BanMax {
+		d = self.limits.BanMax
+	}
+	state.bannedUntil = now.Add(d)
+}
+
+// sweep forgets, about once a minute, IPs that have nothing open, aren't
+// banned, have had time to refill their rate budget and whose offences
+// have been forgiven: they are indistinguishable from new ones.
+func (self *ipGuard) sweep(now time.Time) {
+	if now.Sub(self.lastSweep) < time.Minute {
+		return
+	}
+	self.lastSweep = now
+
+	refill := time.Duration(0)
+	if self.limits.Rate > 0 {
+		refill = time.Duration(float64(self.limits.Burst) / self.limits.Rate * float64(time.Second))
+	}
+	for ip, state := range self.ips {
+		if state.conns == 0 && !state.bannedUntil.After(now) &&
+			now.Sub(state.last) >= refill && now.Sub(state.bannedUntil) >= self.limits.BanMax {
+			delete(self.ips, ip)
+		}
+	}
+}
+
+// ipKey normalises ip, so that e.g. "::ffff:1.2.3.4" and "1.2.3.4" share
+// their limits.
+func ipKey(ip string) (string, error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return "", ErrInvalidIP
+	}
+	return parsed.String(), nil
+}
+
+// addrIP returns the IP of addr, or "" if it has none, e.g. for Unix
+// domain sockets.
+func addrIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP.String()
+	case *net.UDPAddr:
+		return addr.IP.String()
+	}
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			return ip.String()
+		}
+	}
+	return ""
+}
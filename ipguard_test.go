@@ -0,0 +1,122 @@
+// Copyright (C) 2018 ecofast(胡光耀). All rights reserved.
+// Use of this source code is governed by a BSD-style license.
+
+package tcpsock
+
+import (
+	"testing"
+	"time"
+)
+
+// guardStep admits a connection, or releases one, at the given time since
+// the start and checks the outcome, then the IP's offences and how long
+// after the start its ban ends (0 if it was never banned).
+type guardStep struct {
+	at       time.Duration
+	release  bool
+	reason   RejectReason
+	ok       bool
+	offences int
+	banned   time.Duration
+}
+
+func TestIPGuard(t *testing.T) {
+	const ip = "10.0.0.1"
+	s := time.Second
+	cases := []struct {
+		name   string
+		limits IPLimits
+		steps  []guardStep
+	}{
+		{"max conns", IPLimits{MaxConns: 2}, []guardStep{
+			{0, false, 0, true, 0, 0},
+			{0, false, 0, true, 0, 0},
+			{0, false, RejectIPLimit, false, 0, 0},
+			{0, true, 0, true, 0, 0},
+			{0, false, 0, true, 0, 0},
+		}},
+		{"rate", IPLimits{Rate: 2, Burst: 2}, []guardStep{
+			{0, false, 0, true, 0, 0},
+			{0, false, 0, true, 0, 0},
+			{0, false, RejectIPRate, false, 0, 0},
+			{s / 4, false, RejectIPRate, false, 0, 0},
+			{s / 2, false, 0, true, 0, 0},
+			{s / 2, false, RejectIPRate, false, 0, 0},
+		}},
+		{"ban escalation", IPLimits{MaxConns: 2, BanTime: s, BanMax: 4 * s}, []guardStep{
+			{0, false, 0, true, 0, 0},
+			{0, false, 0, true, 0, 0},
+			{0, false, RejectIPLimit, false, 1, s},
+			// banned IPs are turned away without a further offence
+			{s / 2, false, RejectBanned, false, 1, s},
+			{s, false, RejectIPLimit, false, 2, 3 * s},
+			{3 * s, false, RejectIPLimit, false, 3, 7 * s},
+			// the ban doubles up to BanMax only
+			{7 * s, false, RejectIPLimit, false, 4, 11 * s},
+			{11 * s, true, 0, true, 4, 11 * s},
+			{11 * s, false, 0, true, 4, 11 * s},
+		}},
+		{"forgiveness", IPLimits{MaxConns: 1, BanTime: s, BanMax: 4 * s}, []guardStep{
+			{0, false, 0, true, 0, 0},
+			{0, false, RejectIPLimit, false, 1, s},
+			{s, false, RejectIPLimit, false, 2, 3 * s},
+			// BanMax without an offence wipes the slate clean
+			{7 * s, false, RejectIPLimit, false, 1, 8 * s},
+		}},
+		{"no bans", IPLimits{MaxConns: 1}, []guardStep{
+			{0, false, 0, true, 0, 0},
+			{0, false, RejectIPLimit, false, 0, 0},
+			{s, false, RejectIPLimit, false, 0, 0},
+		}},
+	}
+	for _, c := range cases {
+		guard := newIPGuard()
+		guard.limits = c.limits
+		if guard.limits.Burst < 1 {
+			guard.limits.Burst = 1
+		}
+		if guard.limits.BanMax < guard.limits.BanTime {
+			guard.limits.BanMax = guard.limits.BanTime
+		}
+		start := time.Now()
+		for i, step := range c.steps {
+			if step.release {
+				guard.release(ip)
+			} else if reason, ok := guard.admit(ip, start.Add(step.at)); reason != step.reason || ok != step.ok {
+				t.Errorf("%s, step %d: got %v, %v, want %v, %v", c.name, i, reason, ok, step.reason, step.ok)
+			}
+
+			state := guard.ips[ip]
+			banned := time.Duration(0)
+			if !state.bannedUntil.IsZero() {
+				banned = state.bannedUntil.Sub(start)
+			}
+			if state.offences != step.offences || banned != step.banned {
+				t.Errorf("%s, step %d: %d offences, banned for %v, want %d, %v", c.name, i, state.offences, banned, step.offences, step.banned)
+			}
+		}
+	}
+}
+
+func TestBan(t *testing.T) {
+	svr := newTestServer(t, nil)
+	defer svr.Close()
+	if err := svr.Ban("bogus", time.Minute); err != ErrInvalidIP {
+		t.Errorf("Ban of an invalid IP: got %v, want %v", err, ErrInvalidIP)
+	}
+	if err := svr.Ban("::ffff:10.0.0.1", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := svr.ipGuard.admit("10.0.0.1", time.Now()); ok {
+		t.Error("banned IP admitted")
+	}
+	if bans := svr.Bans(); len(bans) != 1 || bans[0].IP != "10.0.0.1" {
+		t.Errorf("got bans %+v", bans)
+	}
+	if !svr.Unban("10.0.0.1") || svr.Unban("10.0.0.1") {
+		t.Error("Unban should report the ban only once")
+	}
+	if reason, ok := svr.ipGuard.admit("10.0.0.1", time.Now()); !ok {
+		t.Errorf("unbanned IP rejected with %v", reason)
+	}
+}
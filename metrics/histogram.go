@@ -0,0 +1,58 @@
+// Copyright (C) 2018 ecofast(胡光耀). All rights reserved.
+// Use of this source code is governed by a BSD-style license.
+
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sync/atomic"
+)
+
+// Histogram counts observations into cumulative buckets the way Prometheus
+// expects them. It is safe for concurrent use.
+type Histogram struct {
+	sum    uint64 // float64 bits
+	bounds []float64
+	counts []uint64 // per bucket, the last one for values above every bound
+}
+
+// NewHistogram returns a histogram with the given upper bounds, which must
+// be sorted in increasing order; the +Inf bucket is implicit.
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+func (self *Histogram) Observe(v float64) {
+	i := 0
+	for i < len(self.bounds) && v > self.bounds[i] {
+		i++
+	}
+	atomic.AddUint64(&self.counts[i], 1)
+	for {
+		old := atomic.LoadUint64(&self.sum)
+		sum := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&self.sum, old, sum) {
+			return
+		}
+	}
+}
+
+// write renders the histogram's samples, without HELP and TYPE lines. The
+// count is the total of the buckets as read, rather than a counter of its
+// own, so a concurrent Observe can't make +Inf fall behind a finite bucket.
+func (self *Histogram) write(w io.Writer, name string) {
+	var cumulative uint64
+	for i, bound := range self.bounds {
+		cumulative += atomic.LoadUint64(&self.counts[i])
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(bound), cumulative)
+	}
+	count := cumulative + atomic.LoadUint64(&self.counts[len(self.bounds)])
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, formatFloat(math.Float64frombits(atomic.LoadUint64(&self.sum))))
+	fmt.Fprintf(w, "%s_count %d\n", name, count)
+}
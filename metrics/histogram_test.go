@@ -0,0 +1,76 @@
+// Copyright (C) 2018 ecofast(胡光耀). All rights reserved.
+// Use of this source code is governed by a BSD-style license.
+
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram([]float64{1, 5})
+	for _, v := range []float64{0.5, 1, 3, 5, 7, 100} {
+		h.Observe(v)
+	}
+	var buf bytes.Buffer
+	h.write(&buf, "x")
+	want := `x_bucket{le="1"} 2
+x_bucket{le="5"} 4
+x_bucket{le="+Inf"} 6
+x_sum 116.5
+x_count 6
+`
+	if buf.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+// TestHistogramScrape checks that a scrape racing with Observe still
+// renders buckets that never decrease.
+func TestHistogramScrape(t *testing.T) {
+	h := NewHistogram([]float64{1, 5})
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					h.Observe(0.5)
+				}
+			}
+		}()
+	}
+	defer wg.Wait()
+	defer close(stop)
+
+	for i := 0; i < 20000; i++ {
+		var buf bytes.Buffer
+		h.write(&buf, "x")
+		var last uint64
+		scanner := bufio.NewScanner(&buf)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !strings.HasPrefix(line, "x_bucket") {
+				continue
+			}
+			n, err := strconv.ParseUint(line[strings.LastIndexByte(line, ' ')+1:], 10, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n < last {
+				t.Fatalf("bucket fell behind: %q after %d", line, last)
+			}
+			last = n
+		}
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright (C) 2018 ecofast(胡光耀). All rights reserved.
+// Use of this source code is governed by a BSD-style license.
+
+// Package metrics exposes a TcpServer's counters in the Prometheus text
+// exposition format through a plain http.Handler:
+//
+//	collector := metrics.New(svr, "chatroom")
+//	svr.SetHandlerObserver(collector.ObserveHandler)
+//	http.Handle("/metrics", collector)
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"tcpsock.v2"
+)
+
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var (
+	// QueueBuckets are the upper bounds, in bytes, of the send queue depth
+	// histogram.
+	QueueBuckets = []float64{0, 256, 1024, 4096, 16384, 65536, 262144, 1048576}
+	// LatencyBuckets are the upper bounds, in seconds, of the handler
+	// latency histogram.
+	LatencyBuckets = []float64{.00005, .0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+)
+
+type Collector struct {
+	svr       *tcpsock.TcpServer
+	namespace string
+	latency   *Histogram
+	router    *tcpsock.Router
+}
+
+// New returns a collector for svr whose metric names start with namespace
+// (tcpsock if empty). Handler latency is only recorded once ObserveHandler
+// is installed with svr.SetHandlerObserver.
+func New(svr *tcpsock.TcpServer, namespace string) *Collector {
+	if svr == nil {
+		panic(errors.New("invalid param of svr for New"))
+	}
+	if namespace == "" {
+		namespace = "tcpsock"
+	}
+
+	return &Collector{
+		svr:       svr,
+		namespace: namespace,
+		latency:   NewHistogram(LatencyBuckets),
+	}
+}
+
+// SetRouter adds per-route message, error and handler time counters of
+// router to the output. It must be called before the collector is served.
+func (self *Collector) SetRouter(router *tcpsock.Router) {
+	self.router = router
+}
+
+func (self *Collector) ObserveHandler(conn *tcpsock.TcpConn, elapsed time.Duration) {
+	self.latency.Observe(elapsed.Seconds())
+}
+
+func (self *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	self.WriteTo(&buf)
+	w.Header().Set("Content-Type", contentType)
+	w.Write(buf.Bytes())
+}
+
+// WriteTo renders all metrics to w.
+func (self *Collector) WriteTo(w io.Writer) (int64, error) {
+	stats := self.svr.Totals()
+	cw := &countingWriter{w: w}
+
+	self.header(cw, "connections_active", "gauge", "Number of open connections.")
+	fmt.Fprintf(cw, "%s %d\n", self.name("connections_active"), stats.Active)
+
+	self.header(cw, "accepts_total", "counter", "Connections accepted.")
+	fmt.Fprintf(cw, "%s %d\n", self.name("accepts_total"), stats.Accepted)
+
+	self.header(cw, "rejects_total", "counter", "Connections turned away, by reason.")
+	rejects := make(map[string]uint64, len(stats.Rejected))
+	for reason, n := range stats.Rejected {
+		rejects[reason.String()] = n
+	}
+	self.writeByReason(cw, "rejects_total", rejects)
+
+	self.header(cw, "closes_total", "counter", "Connections closed, by reason.")
+	closes := make(map[string]uint64, len(stats.Closed))
+	for reason, n := range stats.Closed {
+		closes[reason.String()] = n
+	}
+	self.writeByReason(cw, "closes_total", closes)
+
+	for _, c := range []struct {
+		name, help string
+		value      uint64
+	}{
+		{"received_bytes_total", "Bytes read from connections.", stats.BytesIn},
+		{"sent_bytes_total", "Bytes written to connections.", stats.BytesOut},
+		{"received_frames_total", "Frames handed to sessions.", stats.FramesIn},
+		{"sent_frames_total", "Messages written to connections.", stats.FramesOut},
+	} {
+		self.header(cw, c.name, "counter", c.help)
+		fmt.Fprintf(cw, "%s %d\n", self.name(c.name), c.value)
+	}
+
+	// the queue histogram is a point in time view, rebuilt on every scrape
+	queues := NewHistogram(QueueBuckets)
+	self.svr.IterateConns(func(conn *tcpsock.TcpConn) {
+		_, bytes := conn.QueueLen()
+		queues.Observe(float64(bytes))
+	})
+	self.header(cw, "send_queue_bytes", "histogram", "Send queue depth of open connections.")
+	queues.write(cw, self.name("send_queue_bytes"))
+
+	self.header(cw, "handler_duration_seconds", "histogram", "Time taken by sessions to handle a frame.")
+	self.latency.write(cw, self.name("handler_duration_seconds"))
+
+	if self.router != nil {
+		self.writeRoutes(cw)
+	}
+	return cw.n, cw.err
+}
+
+func (self *Collector) writeRoutes(w io.Writer) {
+	routes, unknown := self.router.Stats()
+	for _, m := range []struct {
+		name, kind, help string
+		value            func(route tcpsock.RouteStats) string
+	}{
+		{"route_messages_total", "counter", "Messages dispatched, by route.", func(route tcpsock.RouteStats) string {
+			return strconv.FormatUint(route.Count, 10)
+		}},
+		{"route_errors_total", "counter", "Handler errors, by route.", func(route tcpsock.RouteStats) string {
+			return strconv.FormatUint(route.Errors, 10)
+		}},
+		{"route_too_large_total", "counter", "Messages over the route's body limit.", func(route tcpsock.RouteStats) string {
+			return strconv.FormatUint(route.TooLarge, 10)
+		}},
+		{"route_handler_seconds_total", "counter", "Time spent in handlers, by route.", func(route tcpsock.RouteStats) string {
+			return formatFloat(route.Time.Seconds())
+		}},
+	} {
+		self.header(w, m.name, m.kind, m.help)
+		for _, route := range routes {
+			fmt.Fprintf(w, "%s{route=\"%d\"} %s\n", self.name(m.name), route.ID, m.value(route))
+		}
+	}
+	self.header(w, "unknown_messages_total", "counter", "Messages without a route.")
+	fmt.Fprintf(w, "%s %d\n", self.name("unknown_messages_total"), unknown)
+}
+
+func (self *Collector) name(metric string) string {
+	return self.namespace + "_" + metric
+}
+
+func (self *Collector) header(w io.Writer, metric, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", self.name(metric), help, self.name(metric), kind)
+}
+
+func (self *Collector) writeByReason(w io.Writer, metric string, counts map[string]uint64) {
+	reasons := make([]string, 0, len(counts))
+	for reason := range counts {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "%s{reason=%q} %d\n", self.name(metric), labelValue(reason), counts[reason])
+	}
+}
+
+// labelValue turns e.g. "peer EOF" into "peer_eof".
+func labelValue(s string) string {
+	return strings.ReplaceAll(strings.ToLower(s), " ", "_")
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (self *countingWriter) Write(p []byte) (int, error) {
+	if self.err != nil {
+		return 0, self.err
+	}
+	n, err := self.w.Write(p)
+	self.n += int64(n)
+	self.err = err
+	return n, err
+}
@@ -0,0 +1,165 @@
+// Copyright (C) 2018 ecofast(胡光耀). All rights reserved.
+// Use of this source code is governed by a BSD-style license.
+
+package tcpsock
+
+import (
+	"errors"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+var (
+	ErrRateLimited = errors.New("rate limited")
+)
+
+type OnMsgGuard = func(session TcpSession, msg Message) bool
+type OnMsgDone = func(session TcpSession, msg Message, elapsed time.Duration, err error)
+type OnMsgLog = func(format string, v ...interface{})
+
+// Recover turns a panic in the wrapped handler into a *PanicError, so the
+// connection is closed with ClosePanic without the panic ever reaching the
+// library's own handler. That includes the one set with SetPanicHandler,
+// and the stack is only kept in the error's Stack field, so leave Recover
+// out where that handler should see panics.
+func Recover() Middleware {
+	return func(next MsgHandler) MsgHandler {
+		return func(session TcpSession, msg Message) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = &PanicError{Value: r, Stack: debug.Stack()}
+				}
+			}()
+			return next(session, msg)
+		}
+	}
+}
+
+// Guard only lets messages for which allow returns true through. Others
+// make the handler return err, or are silently dropped if err is nil.
+func Guard(allow OnMsgGuard, err error) Middleware {
+	if allow == nil {
+		panic(errors.New("invalid param of allow for Guard"))
+	}
+
+	return func(next MsgHandler) MsgHandler {
+		return func(session TcpSession, msg Message) error {
+			if !allow(session, msg) {
+				return err
+			}
+			return next(session, msg)
+		}
+	}
+}
+
+// Timing tells onDone how long the wrapped handler took and what it
+// returned.
+func Timing(onDone OnMsgDone) Middleware {
+	if onDone == nil {
+		panic(errors.New("invalid param of onDone for Timing"))
+	}
+
+	return func(next MsgHandler) MsgHandler {
+		return func(session TcpSession, msg Message) error {
+			start := time.Now()
+			err := next(session, msg)
+			onDone(session, msg, time.Since(start), err)
+			return err
+		}
+	}
+}
+
+// Logging logs every message with its outcome through logf, e.g.
+// log.Printf.
+func Logging(logf OnMsgLog) Middleware {
+	if logf == nil {
+		panic(errors.New("invalid param of logf for Logging"))
+	}
+
+	return Timing(func(session TcpSession, msg Message, elapsed time.Duration, err error) {
+		logf("session %d: message %d (%d bytes) took %v, err: %v\n", session.SockHandle(), msg.ID, len(msg.Body), elapsed, err)
+	})
+}
+
+// RateLimit allows each session rate messages per second through the
+// wrapped handler, with bursts of up to burst messages. Messages over the
+// limit make the handler return err, or are silently dropped if err is
+// nil. Each call returns a limiter of its own, so using it on several
+// routes limits them separately.
+func RateLimit(rate float64, burst int, err error) Middleware {
+	if rate <= 0 {
+		panic(errors.New("invalid param of rate for RateLimit"))
+	}
+	if burst < 1 {
+		panic(errors.New("invalid param of burst for RateLimit"))
+	}
+
+	limiter := newRateLimiter(rate, burst)
+	return func(next MsgHandler) MsgHandler {
+		return func(session TcpSession, msg Message) error {
+			if !limiter.allow(session.SockHandle(), time.Now()) {
+				return err
+			}
+			return next(session, msg)
+		}
+	}
+}
+
+// rateLimiter keeps a token bucket per key.
+type rateLimiter struct {
+	mutex     sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[uint64]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		buckets:   make(map[uint64]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// refill is how long an empty bucket takes to fill up; a bucket left alone
+// that long is as good as a new one and can be forgotten.
+func (self *rateLimiter) refill() time.Duration {
+	return time.Duration(self.burst / self.rate * float64(time.Second))
+}
+
+func (self *rateLimiter) allow(key uint64, now time.Time) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if refill := self.refill(); now.Sub(self.lastSweep) >= refill {
+		for k, bucket := range self.buckets {
+			if now.Sub(bucket.last) >= refill {
+				delete(self.buckets, k)
+			}
+		}
+		self.lastSweep = now
+	}
+
+	bucket, ok := self.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: self.burst, last: now}
+		self.buckets[key] = bucket
+	}
+	if bucket.tokens += now.Sub(bucket.last).Seconds() * self.rate; bucket.tokens > self.burst {
+		bucket.tokens = self.burst
+	}
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
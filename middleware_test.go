@@ -0,0 +1,130 @@
+// Copyright (C) 2018 ecofast(胡光耀). All rights reserved.
+// Use of this source code is governed by a BSD-style license.
+
+package tcpsock
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMiddleware(t *testing.T) {
+	errDenied := errors.New("denied")
+	errHandler := errors.New("handler failed")
+	odd := func(session TcpSession, msg Message) bool {
+		return msg.ID%2 == 1
+	}
+	cases := []struct {
+		name       string
+		middleware Middleware
+		id         uint32
+		err        error
+		called     bool
+	}{
+		{"guard allows", Guard(odd, errDenied), 1, nil, true},
+		{"guard denies", Guard(odd, errDenied), 2, errDenied, false},
+		{"guard drops", Guard(odd, nil), 2, nil, false},
+		{"recover passes errors on", Recover(), 3, errHandler, true},
+	}
+	for _, c := range cases {
+		called := false
+		handler := c.middleware(func(session TcpSession, msg Message) error {
+			called = true
+			if msg.ID == 3 {
+				return errHandler
+			}
+			return nil
+		})
+		if err := handler(idSession(1), Message{ID: c.id}); err != c.err {
+			t.Errorf("%s: got %v, want %v", c.name, err, c.err)
+		}
+		if called != c.called {
+			t.Errorf("%s: handler called: %v, want %v", c.name, called, c.called)
+		}
+	}
+}
+
+func TestRecover(t *testing.T) {
+	handler := Recover()(func(session TcpSession, msg Message) error {
+		panic("boom")
+	})
+	err := handler(idSession(1), Message{})
+	var panicErr *PanicError
+	if !errors.As(err, &panicErr) {
+		t.Fatalf("got %v, want a *PanicError", err)
+	}
+	if panicErr.Value != "boom" || len(panicErr.Stack) == 0 {
+		t.Errorf("got %v with a %d byte stack", panicErr.Value, len(panicErr.Stack))
+	}
+	if dispatchCloseReason(err) != ClosePanic {
+		t.Errorf("closes with %v, want ClosePanic", dispatchCloseReason(err))
+	}
+}
+
+func TestTiming(t *testing.T) {
+	errHandler := errors.New("handler failed")
+	var done struct {
+		id      uint32
+		elapsed time.Duration
+		err     error
+	}
+	handler := Timing(func(session TcpSession, msg Message, elapsed time.Duration, err error) {
+		done.id, done.elapsed, done.err = msg.ID, elapsed, err
+	})(func(session TcpSession, msg Message) error {
+		time.Sleep(10 * time.Millisecond)
+		return errHandler
+	})
+	if err := handler(idSession(1), Message{ID: 5}); err != errHandler {
+		t.Errorf("got %v, want %v", err, errHandler)
+	}
+	if done.id != 5 || done.err != errHandler || done.elapsed < 10*time.Millisecond {
+		t.Errorf("onDone got %+v", done)
+	}
+}
+
+// TestRateLimit checks that each session gets a bucket of its own.
+func TestRateLimit(t *testing.T) {
+	errLimited := errors.New("limited")
+	handler := RateLimit(1, 3, errLimited)(func(session TcpSession, msg Message) error {
+		return nil
+	})
+	cases := []struct {
+		session idSession
+		err     error
+	}{
+		{1, nil}, {1, nil}, {1, nil}, {1, errLimited},
+		{2, nil}, {2, nil}, {2, nil}, {2, errLimited},
+		{1, errLimited},
+	}
+	for i, c := range cases {
+		if err := handler(c.session, Message{}); err != c.err {
+			t.Errorf("message %d from %d: got %v, want %v", i, c.session, err, c.err)
+		}
+	}
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	limiter := newRateLimiter(10, 2)
+	now := time.Now()
+	cases := []struct {
+		after time.Duration
+		allow bool
+	}{
+		{0, true},
+		{0, true},
+		{0, false},
+		{50 * time.Millisecond, false},
+		{100 * time.Millisecond, true},
+		{100 * time.Millisecond, false},
+		// a full bucket doesn't grow past burst
+		{time.Hour, true},
+		{time.Hour, true},
+		{time.Hour, false},
+	}
+	for i, c := range cases {
+		if allow := limiter.allow(1, now.Add(c.after)); allow != c.allow {
+			t.Errorf("case %d: allow = %v, want %v", i, allow, c.allow)
+		}
+	}
+}
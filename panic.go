@@ -0,0 +1,77 @@
+// Copyright (C) 2018 ecofast(胡光耀). All rights reserved.
+// Use of this source code is governed by a BSD-style license.
+
+package tcpsock
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+)
+
+// PanicPolicy tells the library what to do after a recovered panic.
+type PanicPolicy int
+
+const (
+	// PanicClose closes the connection with ClosePanic.
+	PanicClose PanicPolicy = iota
+	// PanicContinue drops whatever was being handled, e.g. the frame
+	// passed to the session's Read, and keeps the connection. Where that
+	// isn't possible, such as inside the send loop, it acts as PanicClose.
+	PanicContinue
+	// PanicCrash re-panics, taking the whole process down.
+	PanicCrash
+)
+
+// OnTcpPanic gets the connection (nil for panics in the accept loop), the
+// recovered value and the stack of the panicking goroutine.
+type OnTcpPanic = func(conn *TcpConn, v interface{}, stack []byte) PanicPolicy
+
+// PanicError is the error a connection is closed with after a panic.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (self *PanicError) Error() string {
+	return fmt.Sprintf("tcpsock: panic: %v", self.Value)
+}
+
+// SetPanicHandler installs onPanic for panics in session callbacks
+// (onConnect, Read, onPing) and in the library's own goroutines. Without a
+// handler every panic closes its connection. It must be called before
+// serving or opening.
+func (self *tcpSock) SetPanicHandler(onPanic OnTcpPanic) {
+	self.onPanic = onPanic
+}
+
+// recovered must be called with the value of recover() from a deferred
+// function. It consults the panic handler, crashing right here for
+// PanicCrash, and returns the error to close conn with along with the
+// chosen policy.
+func (self *tcpSock) recovered(conn *TcpConn, v interface{}) (*PanicError, PanicPolicy) {
+	err := &PanicError{Value: v, Stack: debug.Stack()}
+	policy := PanicClose
+	if self.onPanic != nil {
+		policy = self.onPanic(conn, v, err.Stack)
+	}
+	if policy == PanicCrash {
+		panic(v)
+	}
+	return err, policy
+}
+
+// connect runs onConnect for conn, turning a panic into an error.
+func (self *tcpSock) connect(conn *TcpConn) (session TcpSession, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err, _ = self.recovered(conn, r)
+		}
+	}()
+	return self.onConnect(conn), nil
+}
+
+func isPanicError(err error) bool {
+	var panicErr *PanicError
+	return errors.As(err, &panicErr)
+}
@@ -0,0 +1,75 @@
+// Copyright (C) 2018 ecofast(胡光耀). All rights reserved.
+// Use of this source code is governed by a BSD-style license.
+
+package tcpsock
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	bufClasses = [...]int{64, 256, 1024, 4 * 1024, 16 * 1024, 32 * 1024}
+	bufPools   [len(bufClasses)]sync.Pool
+)
+
+// Buffer is a reference counted byte slice leased from a size-classed pool.
+// GetBuffer hands out one reference; Retain adds more, e.g. to write the
+// same frame to many connections, and each reference must be given back
+// through Release or by passing the buffer to TcpConn.WriteBuffer. The
+// bytes must not be touched once the last reference is gone.
+type Buffer struct {
+	data  []byte
+	class int
+	refs  int32
+}
+
+// GetBuffer leases a buffer of n bytes. Sizes above the largest class are
+// allocated directly and simply left to the GC on release.
+func GetBuffer(n int) *Buffer {
+	for i, size := range bufClasses {
+		if n <= size {
+			buf, _ := bufPools[i].Get().(*Buffer)
+			if buf == nil {
+				buf = &Buffer{data: make([]byte, size), class: i}
+			}
+			buf.data = buf.data[:n]
+			buf.refs = 1
+			return buf
+		}
+	}
+	return &Buffer{data: make([]byte, n), class: -1, refs: 1}
+}
+
+func (self *Buffer) Bytes() []byte {
+	return self.data
+}
+
+func (self *Buffer) Len() int {
+	return len(self.data)
+}
+
+// Truncate shortens the buffer to n bytes, e.g. after encoding into a
+// buffer leased for the worst case.
+func (self *Buffer) Truncate(n int) {
+	if n < 0 || n > len(self.data) {
+		panic(errors.New("invalid param of n for Buffer.Truncate"))
+	}
+	self.data = self.data[:n]
+}
+
+func (self *Buffer) Retain() *Buffer {
+	atomic.AddInt32(&self.refs, 1)
+	return self
+}
+
+func (self *Buffer) Release() {
+	refs := atomic.AddInt32(&self.refs, -1)
+	if refs < 0 {
+		panic(errors.New("tcpsock: Buffer released too many times"))
+	}
+	if refs == 0 && self.class >= 0 {
+		bufPools[self.class].Put(self)
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright (C) 2018 ecofast(胡光耀). All rights reserved.
+// Use of this source code is governed by a BSD-style license.
+
+package tcpsock
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+const benchFrameSize = 128
+
+type discardSession struct {
+	conn *TcpConn
+}
+
+func (self *discardSession) SockHandle() uint64 {
+	return self.conn.ID()
+}
+
+func (self *discardSession) Read(b []byte) (n int, err error) {
+	return len(b), nil
+}
+
+func (self *discardSession) Write(b []byte) (n int, err error) {
+	return self.conn.Write(b)
+}
+
+func (self *discardSession) Close() error {
+	return self.conn.Close()
+}
+
+// discardConn returns the server side of a loopback connection whose peer
+// discards everything it receives.
+func discardConn(tb testing.TB, codec Codec) (*TcpConn, func()) {
+	connChan := make(chan *TcpConn, 1)
+	svr := NewTcpServer("127.0.0.1:0", func(conn *TcpConn) TcpSession {
+		connChan <- conn
+		return &discardSession{conn: conn}
+	}, func(conn *TcpConn, reason CloseReason) {}, nil)
+	if codec != nil {
+		svr.SetCodec(codec)
+	}
+	svr.Serve()
+
+	peer, err := net.Dial("tcp", svr.Addr().String())
+	if err != nil {
+		svr.Close()
+		tb.Fatal(err)
+	}
+	go io.Copy(io.Discard, peer)
+	return <-connChan, func() {
+		peer.Close()
+		svr.Close()
+	}
+}
+
+func BenchmarkWrite(b *testing.B) {
+	conn, done := discardConn(b, nil)
+	defer done()
+
+	b.ReportAllocs()
+	b.SetBytes(benchFrameSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := conn.Write(make([]byte, benchFrameSize)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWriteBuffer(b *testing.B) {
+	conn, done := discardConn(b, nil)
+	defer done()
+
+	b.ReportAllocs()
+	b.SetBytes(benchFrameSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := conn.WriteBuffer(GetBuffer(benchFrameSize)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWriteFrame(b *testing.B) {
+	conn, done := discardConn(b, NewLengthCodec(LenSize16, binary.BigEndian, 0, false))
+	defer done()
+	frame := make([]byte, benchFrameSize)
+
+	b.ReportAllocs()
+	b.SetBytes(benchFrameSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := conn.WriteFrame(frame); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
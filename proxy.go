@@ -0,0 +1,199 @@
+// Copyright (C) 2018 ecofast(胡光耀). All rights reserved.
+// Use of this source code is governed by a BSD-style license.
+
+package tcpsock
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ProxyTimeoutInSecs = 3
+
+	proxyV1LenMax  = 107
+	proxyV2LenMax  = 4096
+	proxyV2HeadLen = 16
+)
+
+var (
+	ErrInvalidProxyHeader = errors.New("invalid proxy protocol header")
+
+	proxyV1Sig = []byte("PROXY ")
+	proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// SetProxyProtocol makes the server expect a PROXY protocol (v1 or v2)
+// header on every connection from the trusted CIDRs, e.g. those of the
+// load balancers, and take the client address from it. The header must
+// arrive within timeout (ProxyTimeoutInSecs if <= 0), otherwise the
+// connection is dropped. Connections from anywhere else are taken as they
+// are. It must be called before serving.
+func (self *TcpServer) SetProxyProtocol(trusted []string, timeout time.Duration) error {
+	var ranges ipRanges
+	for _, s := range trusted {
+		if err := ranges.add(s); err != nil {
+			return err
+		}
+	}
+	ranges.merge()
+	if timeout <= 0 {
+		timeout = ProxyTimeoutInSecs * time.Second
+	}
+
+	self.proxyNets = ranges
+	self.proxyWait = timeout
+	return nil
+}
+
+// RemoteAddr returns the address of the peer; behind a trusted proxy that
+// is the client's address taken from the PROXY protocol header.
+func (self *TcpConn) RemoteAddr() net.Addr {
+	return self.remote
+}
+
+func (self *TcpServer) fromProxy(addr net.Addr) bool {
+	if len(self.proxyNets) == 0 {
+		return false
+	}
+	ip := net.ParseIP(addrIP(addr))
+	if ip == nil {
+		return false
+	}
+	key, _ := toIPKey(ip)
+	return self.proxyNets.contains(key)
+}
+
+// proxyConn is a connection whose peer address came from a PROXY header.
+// It is only what the reject handler gets to see; served connections keep
+// the raw conn, whose vectored writes a wrapper would hide.
+type proxyConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (self *proxyConn) RemoteAddr() net.Addr {
+	return self.remote
+}
+
+func (self *proxyConn) CloseWrite() error {
+	if conn, ok := self.Conn.(closeWriter); ok {
+		return conn.CloseWrite()
+	}
+	return nil
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// peerConn returns conn reporting remote as its peer address.
+func peerConn(conn net.Conn, remote net.Addr) net.Conn {
+	if remote == nil || remote == conn.RemoteAddr() {
+		return conn
+	}
+	return &proxyConn{Conn: conn, remote: remote}
+}
+
+// readProxyHeader consumes the PROXY header of conn, reading no further,
+// and returns the client address it carries. Headers that carry none, such
+// as v2 LOCAL health checks, return a nil address.
+func (self *TcpServer) readProxyHeader(conn net.Conn) (net.Addr, error) {
+	conn.SetReadDeadline(time.Now().Add(self.proxyWait))
+	defer conn.SetReadDeadline(time.Time{})
+
+	head := make([]byte, len(proxyV2Sig))
+	if _, err := io.ReadFull(conn, head[:len(proxyV1Sig)]); err != nil {
+		return nil, err
+	}
+	if bytes.Equal(head[:len(proxyV1Sig)], proxyV1Sig) {
+		return readProxyV1(conn)
+	}
+	if _, err := io.ReadFull(conn, head[len(proxyV1Sig):]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(head, proxyV2Sig) {
+		return nil, ErrInvalidProxyHeader
+	}
+	return readProxyV2(conn)
+}
+
+// readProxyV1 parses e.g. "TCP4 1.2.3.4 5.6.7.8 1234 80\r\n", the signature
+// having been read already.
+func readProxyV1(r io.Reader) (net.Addr, error) {
+	line := make([]byte, 0, proxyV1LenMax)
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == proxyV1LenMax-len(proxyV1Sig) {
+			return nil, ErrInvalidProxyHeader
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) > 0 && fields[0] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 5 || (fields[0] != "TCP4" && fields[0] != "TCP6") {
+		return nil, ErrInvalidProxyHeader
+	}
+	ip := net.ParseIP(fields[1])
+	port, err := strconv.ParseUint(fields[3], 10, 16)
+	if ip == nil || err != nil || (fields[0] == "TCP4") != (ip.To4() != nil) {
+		return nil, ErrInvalidProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 parses the binary header that follows the signature.
+func readProxyV2(r io.Reader) (net.Addr, error) {
+	head := make([]byte, proxyV2HeadLen-len(proxyV2Sig))
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	if head[0]>>4 != 2 {
+		return nil, ErrInvalidProxyHeader
+	}
+	length := int(binary.BigEndian.Uint16(head[2:]))
+	if length > proxyV2LenMax {
+		return nil, ErrInvalidProxyHeader
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	// LOCAL connections, e.g. health checks, and address families other
+	// than TCP over IPv4/IPv6 keep the real peer address
+	if head[0]&0x0F == 0 {
+		return nil, nil
+	}
+	if head[0]&0x0F != 1 {
+		return nil, ErrInvalidProxyHeader
+	}
+	var ipLen int
+	switch head[1] {
+	case 0x11:
+		ipLen = net.IPv4len
+	case 0x21:
+		ipLen = net.IPv6len
+	default:
+		return nil, nil
+	}
+	if length < 2*ipLen+4 {
+		return nil, ErrInvalidProxyHeader
+	}
+	ip := make(net.IP, ipLen)
+	copy(ip, body[:ipLen])
+	port := binary.BigEndian.Uint16(body[2*ipLen:])
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
@@ -0,0 +1,118 @@
+// Copyright (C) 2018 ecofast(胡光耀). All rights reserved.
+// Use of this source code is governed by a BSD-style license.
+
+package tcpsock
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestReadProxyV1(t *testing.T) {
+	cases := []struct {
+		line string
+		addr string
+		err  bool
+	}{
+		{"TCP4 1.2.3.4 5.6.7.8 1234 80\r\n", "1.2.3.4:1234", false},
+		{"TCP6 2001:db8::1 2001:db8::2 65535 443\r\n", "[2001:db8::1]:65535", false},
+		{"UNKNOWN\r\n", "", false},
+		{"UNKNOWN 1.2.3.4 5.6.7.8 1 2\r\n", "", false},
+		{"TCP4 2001:db8::1 5.6.7.8 1234 80\r\n", "", true},
+		{"TCP6 1.2.3.4 5.6.7.8 1234 80\r\n", "", true},
+		{"TCP4 1.2.3.4 5.6.7.8 65536 80\r\n", "", true},
+		{"TCP4 1.2.3.4 5.6.7.8 1234\r\n", "", true},
+		{"UDP4 1.2.3.4 5.6.7.8 1234 80\r\n", "", true},
+		{"TCP4 1.2.3.4 5.6.7.8 1234 80", "", true},
+		{strings.Repeat("x", proxyV1LenMax) + "\r\n", "", true},
+	}
+	for _, c := range cases {
+		r := strings.NewReader(c.line + "payload")
+		addr, err := readProxyV1(r)
+		if (err != nil) != c.err {
+			t.Errorf("readProxyV1(%q) error = %v", c.line, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got := addrString(addr); got != c.addr {
+			t.Errorf("readProxyV1(%q) = %s, want %s", c.line, got, c.addr)
+		}
+		if rest := r.Len(); rest != len("payload") {
+			t.Errorf("readProxyV1(%q) read %d bytes too many", c.line, len("payload")-rest)
+		}
+	}
+}
+
+func proxyV2Header(cmd, family byte, body []byte) []byte {
+	head := []byte{0x20 | cmd, family, 0, 0}
+	binary.BigEndian.PutUint16(head[2:], uint16(len(body)))
+	return append(head, body...)
+}
+
+func proxyV2Body(src, dst net.IP, srcPort, dstPort uint16) []byte {
+	body := append(append([]byte{}, src...), dst...)
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports, srcPort)
+	binary.BigEndian.PutUint16(ports[2:], dstPort)
+	return append(body, ports...)
+}
+
+func TestReadProxyV2(t *testing.T) {
+	v4 := proxyV2Body(net.ParseIP("1.2.3.4").To4(), net.ParseIP("5.6.7.8").To4(), 1234, 80)
+	v6 := proxyV2Body(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), 4321, 443)
+	tlvs := append(append([]byte{}, v4...), 0x04, 0, 2, 'h', 'i')
+
+	cases := []struct {
+		name   string
+		header []byte
+		addr   string
+		err    bool
+	}{
+		{"tcp4", proxyV2Header(1, 0x11, v4), "1.2.3.4:1234", false},
+		{"tcp6", proxyV2Header(1, 0x21, v6), "[2001:db8::1]:4321", false},
+		{"tlvs", proxyV2Header(1, 0x11, tlvs), "1.2.3.4:1234", false},
+		{"local", proxyV2Header(0, 0x00, nil), "", false},
+		{"unix", proxyV2Header(1, 0x31, make([]byte, 216)), "", false},
+		{"udp4", proxyV2Header(1, 0x12, v4), "", false},
+		{"bad command", proxyV2Header(2, 0x11, v4), "", true},
+		{"bad version", append([]byte{0x11}, proxyV2Header(1, 0x11, v4)[1:]...), "", true},
+		{"short body", proxyV2Header(1, 0x21, v4), "", true},
+		{"too long", proxyV2Header(1, 0x11, make([]byte, proxyV2LenMax+1)), "", true},
+	}
+	for _, c := range cases {
+		r := bytes.NewReader(append(c.header, "payload"...))
+		addr, err := readProxyV2(r)
+		if (err != nil) != c.err {
+			t.Errorf("%s: error = %v", c.name, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got := addrString(addr); got != c.addr {
+			t.Errorf("%s: addr = %s, want %s", c.name, got, c.addr)
+		}
+		if rest := r.Len(); rest != len("payload") {
+			t.Errorf("%s: read %d bytes too many", c.name, len("payload")-rest)
+		}
+	}
+
+	header := proxyV2Header(1, 0x11, v4)
+	for _, n := range []int{2, 4, len(header) - 1} {
+		if _, err := readProxyV2(bytes.NewReader(header[:n])); err == nil {
+			t.Errorf("header truncated to %d bytes accepted", n)
+		}
+	}
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
@@ -0,0 +1,320 @@
+// Copyright (C) 2018 ecofast(胡光耀). All rights reserved.
+// Use of this source code is governed by a BSD-style license.
+
+package tcpsock
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	sendQueueLenDef  = 20
+	sendBatchSizeDef = 64 * 1024
+	sendBatchMsgsMax = 1024
+)
+
+// SendPolicy decides what TcpConn.Write does when the send queue is full.
+type SendPolicy int
+
+const (
+	// SendBlock waits for room in the queue, up to the configured timeout.
+	SendBlock SendPolicy = iota
+	// SendDropNewest silently discards the message being written.
+	SendDropNewest
+	// SendDropOldest discards queued messages until the new one fits.
+	SendDropOldest
+	// SendDisconnect closes the connection with ErrSlowConsumer.
+	SendDisconnect
+	// SendReject returns ErrSendQueueFull to the writer.
+	SendReject
+)
+
+var (
+	ErrSendQueueFull = errors.New("send queue full")
+	ErrSlowConsumer  = errors.New("slow consumer")
+)
+
+// SetSendQueue bounds every connection's send queue to maxMsgs messages
+// and, if maxBytes > 0, to maxBytes queued bytes, and picks what happens
+// when a write doesn't fit. timeout only applies to SendBlock; zero waits
+// forever. A single message is always let into an empty queue, however
+// large. It must be called before serving or opening.
+func (self *tcpSock) SetSendQueue(policy SendPolicy, maxMsgs, maxBytes int, timeout time.Duration) {
+	if maxMsgs <= 0 {
+		maxMsgs = sendQueueLenDef
+	}
+	self.sendPolicy = policy
+	self.sendQueueLen = maxMsgs
+	self.sendQueueBytes = maxBytes
+	self.sendTimeout = timeout
+}
+
+// SetWriteBatch tunes how the send goroutine coalesces queued messages into
+// one vectored write: at most maxBytes per write (values <= 0 restore the
+// 64 KiB default), waiting up to window for more messages to arrive before
+// flushing a batch that isn't full. A zero window flushes whatever is
+// pending right away. It must be called before serving or opening.
+func (self *tcpSock) SetWriteBatch(maxBytes int, window time.Duration) {
+	self.batchBytes = maxBytes
+	self.writeWindow = window
+}
+
+func (self *tcpSock) batchSize() int {
+	if self.batchBytes <= 0 {
+		return sendBatchSizeDef
+	}
+	return self.batchBytes
+}
+
+func (self *tcpSock) queueLen() int {
+	if self.sendQueueLen <= 0 {
+		return sendQueueLenDef
+	}
+	return self.sendQueueLen
+}
+
+// QueueLen returns the number of messages and bytes waiting to be sent.
+func (self *TcpConn) QueueLen() (msgs, bytes int) {
+	return len(self.bufChan), int(atomic.LoadInt64(&self.queued))
+}
+
+func (self *TcpConn) fits(n int) bool {
+	max := int64(self.owner.sendQueueBytes)
+	if max <= 0 {
+		return true
+	}
+	queued := atomic.LoadInt64(&self.queued)
+	return queued == 0 || queued+int64(n) <= max
+}
+
+func (self *TcpConn) tryEnqueue(msg sendMsg) bool {
+	if !self.fits(len(msg.b)) {
+		return false
+	}
+	select {
+	case self.bufChan <- msg:
+		atomic.AddInt64(&self.queued, int64(len(msg.b)))
+		return true
+	default:
+		return false
+	}
+}
+
+func (self *TcpConn) dequeued(msg sendMsg) {
+	atomic.AddInt64(&self.queued, -int64(len(msg.b)))
+	select {
+	case self.spaceChan <- struct{}{}:
+	default:
+	}
+}
+
+// enqueue queues msg according to the send policy. msg's buffer is
+// released whenever msg doesn't make it into the queue.
+func (self *TcpConn) enqueue(msg sendMsg) error {
+	if self.tryEnqueue(msg) {
+		return nil
+	}
+
+	var err error
+	switch self.owner.sendPolicy {
+	case SendDropNewest:
+	case SendDropOldest:
+		err = self.enqueueDropOldest(msg)
+	case SendDisconnect:
+		self.closeWith(CloseSlowConsumer, ErrSlowConsumer)
+		err = ErrSendQueueFull
+	case SendReject:
+		err = ErrSendQueueFull
+	default:
+		err = self.enqueueWait(msg)
+	}
+	if err != nil || self.owner.sendPolicy == SendDropNewest {
+		msg.release()
+	}
+	return err
+}
+
+func (self *TcpConn) enqueueDropOldest(msg sendMsg) error {
+	for !self.tryEnqueue(msg) {
+		if self.closed() {
+			return ErrConnClosed
+		}
+		select {
+		case old := <-self.bufChan:
+			self.dequeued(old)
+			old.release()
+		default:
+		}
+	}
+	return nil
+}
+
+func (self *TcpConn) enqueueWait(msg sendMsg) error {
+	var timeout <-chan time.Time
+	if self.owner.sendTimeout > 0 {
+		timer := time.NewTimer(self.owner.sendTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		if self.fits(len(msg.b)) {
+			select {
+			case self.bufChan <- msg:
+				atomic.AddInt64(&self.queued, int64(len(msg.b)))
+				return nil
+			case <-self.closeChan:
+				return ErrConnClosed
+			case <-timeout:
+				return ErrSendQueueFull
+			}
+		}
+
+		select {
+		case <-self.spaceChan:
+		case <-self.closeChan:
+			return ErrConnClosed
+		case <-timeout:
+			return ErrSendQueueFull
+		}
+	}
+}
+
+// discard empties the queue of a closed connection, releasing any leased
+// buffers in it.
+func (self *TcpConn) discard() {
+	for {
+		select {
+		case msg := <-self.bufChan:
+			self.dequeued(msg)
+			msg.release()
+		default:
+			return
+		}
+	}
+}
+
+// sendMsg is one queued write. buf, if set, owns b and is released once b
+// has been written or dropped.
+type sendMsg struct {
+	b   []byte
+	buf *Buffer
+}
+
+func (self sendMsg) release() {
+	if self.buf != nil {
+		self.buf.Release()
+	}
+}
+
+// sendBatch collects queued messages for a single vectored write.
+type sendBatch struct {
+	bufs   net.Buffers
+	leases []*Buffer
+	size   int
+}
+
+func newSendBatch() *sendBatch {
+	return &sendBatch{
+		bufs:   make(net.Buffers, 0, sendBatchMsgsMax),
+		leases: make([]*Buffer, 0, sendBatchMsgsMax),
+	}
+}
+
+func (self *sendBatch) add(msg sendMsg) {
+	self.bufs = append(self.bufs, msg.b)
+	if msg.buf != nil {
+		self.leases = append(self.leases, msg.buf)
+	}
+	self.size += len(msg.b)
+}
+
+func (self *sendBatch) writeTo(w io.Writer) error {
+	var n int
+	var err error
+	switch {
+	case len(self.bufs) == 1:
+		n, err = w.Write(self.bufs[0])
+	case writev(w):
+		// WriteTo consumes the slice it's called on, so hand it a copy
+		bufs := self.bufs
+		var n64 int64
+		n64, err = bufs.WriteTo(w)
+		n = int(n64)
+	default:
+		// anything else, e.g. a *tls.Conn, would get one Write, and so one
+		// syscall or TLS record, per message
+		n, err = self.writeFlat(w)
+	}
+	if err == nil && n != self.size {
+		err = io.ErrShortWrite
+	}
+	return err
+}
+
+// writeFlat copies the batch into pooled buffers, in chunks no larger than
+// the largest class so none of them is allocated outside the pool, and
+// writes each chunk in one go.
+func (self *sendBatch) writeFlat(w io.Writer) (int, error) {
+	size := self.size
+	if max := bufClasses[len(bufClasses)-1]; size > max {
+		size = max
+	}
+	flat := GetBuffer(size)
+	defer flat.Release()
+	chunk := flat.Bytes()
+
+	n, off := 0, 0
+	for _, b := range self.bufs {
+		for len(b) > 0 {
+			c := copy(chunk[off:], b)
+			b = b[c:]
+			off += c
+			if off < len(chunk) {
+				continue
+			}
+			m, err := w.Write(chunk)
+			n += m
+			if err != nil {
+				return n, err
+			}
+			off = 0
+		}
+	}
+	if off > 0 {
+		m, err := w.Write(chunk[:off])
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// writev reports whether net.Buffers.WriteTo turns into a single vectored
+// write on w rather than one Write per buffer.
+func writev(w io.Writer) bool {
+	switch w.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		return true
+	}
+	return false
+}
+
+// reset releases the leased buffers and empties the batch for reuse.
+func (self *sendBatch) reset() {
+	for i := range self.bufs {
+		self.bufs[i] = nil
+	}
+	for i, buf := range self.leases {
+		buf.Release()
+		self.leases[i] = nil
+	}
+	self.bufs = self.bufs[:0]
+	self.leases = self.leases[:0]
+	self.size = 0
+}
@@ -0,0 +1,127 @@
+// Copyright (C) 2018 ecofast(胡光耀). All rights reserved.
+// Use of this source code is governed by a BSD-style license.
+
+package tcpsock
+
+import (
+	"bytes"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// chunkWriter records the size of every Write; being neither a TCP nor a
+// Unix conn, it gets batches flattened.
+type chunkWriter struct {
+	bytes.Buffer
+	writes []int
+}
+
+func (self *chunkWriter) Write(b []byte) (int, error) {
+	self.writes = append(self.writes, len(b))
+	return self.Buffer.Write(b)
+}
+
+func TestSendBatchFlat(t *testing.T) {
+	max := bufClasses[len(bufClasses)-1]
+	cases := map[string][]int{
+		"small":      {10, 20, 30},
+		"one chunk":  {max / 2, max / 2},
+		"straddling": {max - 1, 2, max},
+		"large":      {3 * max, 100, 64 * 1024},
+	}
+	for name, sizes := range cases {
+		batch := newSendBatch()
+		var want []byte
+		for i, size := range sizes {
+			b := bytes.Repeat([]byte{byte('a' + i)}, size)
+			batch.bufs = append(batch.bufs, b)
+			batch.size += size
+			want = append(want, b...)
+		}
+
+		var w chunkWriter
+		if err := batch.writeTo(&w); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(w.Bytes(), want) {
+			t.Errorf("%s: wrote %d bytes, not the batch", name, w.Len())
+		}
+		for _, n := range w.writes {
+			if n > max {
+				t.Errorf("%s: wrote %d bytes at once, more than %d", name, n, max)
+			}
+		}
+	}
+}
+
+// TestSendPolicy fills the queue of a connection whose send goroutine never
+// runs, then checks what each policy makes of the writes that don't fit.
+func TestSendPolicy(t *testing.T) {
+	cases := []struct {
+		name     string
+		policy   SendPolicy
+		maxMsgs  int
+		maxBytes int
+		writes   []string
+		errs     []error
+		queued   string
+		closed   bool
+	}{
+		{"drop newest", SendDropNewest, 2, 0, []string{"a", "b", "c"}, []error{nil, nil, nil}, "ab", false},
+		{"drop oldest", SendDropOldest, 2, 0, []string{"a", "b", "c", "d"}, []error{nil, nil, nil, nil}, "cd", false},
+		{"drop oldest by bytes", SendDropOldest, 10, 3, []string{"a", "b", "cc"}, []error{nil, nil, nil}, "bcc", false},
+		{"reject", SendReject, 2, 0, []string{"a", "b", "c"}, []error{nil, nil, ErrSendQueueFull}, "ab", false},
+		{"reject by bytes", SendReject, 10, 3, []string{"aa", "b", "c"}, []error{nil, nil, ErrSendQueueFull}, "aab", false},
+		{"oversized alone", SendReject, 10, 3, []string{"aaaa", "b"}, []error{nil, ErrSendQueueFull}, "aaaa", false},
+		{"disconnect", SendDisconnect, 2, 0, []string{"a", "b", "c", "d"}, []error{nil, nil, ErrSendQueueFull, ErrConnClosed}, "ab", true},
+		{"block timeout", SendBlock, 2, 0, []string{"a", "b", "c"}, []error{nil, nil, ErrSendQueueFull}, "ab", false},
+	}
+	for _, c := range cases {
+		owner := &tcpSock{}
+		owner.SetSendQueue(c.policy, c.maxMsgs, c.maxBytes, 20*time.Millisecond)
+		local, peer := net.Pipe()
+		conn := newTcpConn(1, owner, local, nil)
+
+		bufs := make([]*Buffer, len(c.writes))
+		for i, s := range c.writes {
+			bufs[i] = GetBuffer(len(s))
+			copy(bufs[i].Bytes(), s)
+		}
+		for i, buf := range bufs {
+			if _, err := conn.WriteBuffer(buf); err != c.errs[i] {
+				t.Errorf("%s: write %q: got %v, want %v", c.name, c.writes[i], err, c.errs[i])
+			}
+		}
+
+		if conn.closed() != c.closed {
+			t.Errorf("%s: closed: %v, want %v", c.name, conn.closed(), c.closed)
+		}
+		if c.closed && conn.CloseReason() != CloseSlowConsumer {
+			t.Errorf("%s: closed with %v, want CloseSlowConsumer", c.name, conn.CloseReason())
+		}
+		queued := ""
+		for len(conn.bufChan) > 0 {
+			msg := <-conn.bufChan
+			queued += string(msg.b)
+			conn.dequeued(msg)
+			msg.release()
+		}
+		if queued != c.queued {
+			t.Errorf("%s: queued %q, want %q", c.name, queued, c.queued)
+		}
+		if _, n := conn.QueueLen(); n != 0 {
+			t.Errorf("%s: %d bytes still counted as queued", c.name, n)
+		}
+		// whatever didn't make it into the queue must have been released
+		for i, buf := range bufs {
+			if refs := atomic.LoadInt32(&buf.refs); refs != 0 {
+				t.Errorf("%s: write %q left with %d references", c.name, c.writes[i], refs)
+			}
+		}
+		local.Close()
+		peer.Close()
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright (C) 2018 ecofast(胡光耀). All rights reserved.
+// Use of this source code is governed by a BSD-style license.
+
+package tcpsock
+
+import (
+	"fmt"
+	"io"
+)
+
+// CloseReason tells disconnect handlers why a connection went away.
+type CloseReason int
+
+const (
+	// CloseLocal means TcpConn.Close was called, usually by the session.
+	CloseLocal CloseReason = iota
+	// ClosePeerEOF means the peer closed its end.
+	ClosePeerEOF
+	// CloseReadError covers failed reads, undecodable frames and errors
+	// returned from the session's Read.
+	CloseReadError
+	CloseWriteError
+	CloseKicked
+	CloseShutdown
+	CloseIdleTimeout
+	CloseSlowConsumer
+	ClosePanic
+)
+
+var closeReasonNames = [...]string{
+	CloseLocal:        "local close",
+	ClosePeerEOF:      "peer EOF",
+	CloseReadError:    "read error",
+	CloseWriteError:   "write error",
+	CloseKicked:       "kicked",
+	CloseShutdown:     "server shutdown",
+	CloseIdleTimeout:  "idle timeout",
+	CloseSlowConsumer: "slow consumer",
+	ClosePanic:        "panic",
+}
+
+func (self CloseReason) String() string {
+	if self >= 0 && int(self) < len(closeReasonNames) {
+		return closeReasonNames[self]
+	}
+	return fmt.Sprintf("CloseReason(%d)", int(self))
+}
+
+// SetErrorHandler installs onError, which gets the underlying error each
+// time a connection is closed because of one (a failed read or write, a
+// panic, an idle timeout and so on) right before onDisconnect runs. It
+// must be called before serving or opening.
+func (self *tcpSock) SetErrorHandler(onError OnTcpError) {
+	self.onError = onError
+}
+
+func readCloseReason(err error) CloseReason {
+	if err == nil || err == io.EOF {
+		return ClosePeerEOF
+	}
+	return CloseReadError
+}
@@ -0,0 +1,62 @@
+// Copyright (C) 2018 ecofast(胡光耀). All rights reserved.
+// Use of this source code is governed by a BSD-style license.
+
+package tcpsock
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+type OnReconnectAttempt = func(attempt int, delay time.Duration)
+type OnReconnectSuccess = func(attempt int)
+type OnReconnectGiveUp = func(attempts int, err error)
+
+// ReconnectPolicy tells a TcpClient how to redial after a failed dial or a
+// lost connection. Delays start at MinDelay and grow by Multiplier up to
+// MaxDelay; each one is randomised by up to ±Jitter of itself. A
+// MaxAttempts of 0 retries forever.
+type ReconnectPolicy struct {
+	MinDelay    time.Duration
+	MaxDelay    time.Duration
+	Multiplier  float64
+	Jitter      float64
+	MaxAttempts int
+	OnAttempt   OnReconnectAttempt
+	OnSuccess   OnReconnectSuccess
+	OnGiveUp    OnReconnectGiveUp
+}
+
+func NewReconnectPolicy(minDelay, maxDelay time.Duration, maxAttempts int) *ReconnectPolicy {
+	if minDelay <= 0 || maxDelay < minDelay {
+		panic(errors.New("invalid param of delay for NewReconnectPolicy"))
+	}
+
+	return &ReconnectPolicy{
+		MinDelay:    minDelay,
+		MaxDelay:    maxDelay,
+		Multiplier:  2,
+		Jitter:      0.2,
+		MaxAttempts: maxAttempts,
+	}
+}
+
+// delay returns the randomised wait before the given attempt, counted from 1.
+func (self *ReconnectPolicy) delay(attempt int) time.Duration {
+	d := float64(self.MinDelay)
+	for i := 1; i < attempt && d < float64(self.MaxDelay); i++ {
+		d *= self.Multiplier
+	}
+	if d > float64(self.MaxDelay) {
+		d = float64(self.MaxDelay)
+	}
+	if self.Jitter > 0 {
+		d += d * self.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(d)
+}
+
+func (self *ReconnectPolicy) exhausted(attempt int) bool {
+	return self.MaxAttempts > 0 && attempt > self.MaxAttempts
+}
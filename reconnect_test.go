@@ -0,0 +1,42 @@
+// Copyright (C) 2018 ecofast(胡光耀). All rights reserved.
+// Use of this source code is governed by a BSD-style license.
+
+package tcpsock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReconnectPolicyDelay(t *testing.T) {
+	policy := NewReconnectPolicy(100*time.Millisecond, 2*time.Second, 5)
+	policy.Jitter = 0
+	want := []time.Duration{100, 200, 400, 800, 1600, 2000, 2000}
+	for i, d := range want {
+		if got := policy.delay(i + 1); got != d*time.Millisecond {
+			t.Errorf("delay(%d) = %v, want %v", i+1, got, d*time.Millisecond)
+		}
+	}
+
+	policy.Jitter = 0.2
+	for attempt := 1; attempt < 10; attempt++ {
+		base := float64(policy.MinDelay) * float64(int(1)<<uint(attempt-1))
+		if base > float64(policy.MaxDelay) {
+			base = float64(policy.MaxDelay)
+		}
+		for i := 0; i < 100; i++ {
+			d := float64(policy.delay(attempt))
+			if d < base*0.8 || d > base*1.2 {
+				t.Fatalf("delay(%d) = %v, outside %v ±20%%", attempt, time.Duration(d), time.Duration(base))
+			}
+		}
+	}
+
+	if policy.exhausted(5) || !policy.exhausted(6) {
+		t.Error("a policy of 5 attempts is exhausted after the wrong attempt")
+	}
+	policy.MaxAttempts = 0
+	if policy.exhausted(1000) {
+		t.Error("a policy of unlimited attempts is exhausted")
+	}
+}
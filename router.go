@@ -0,0 +1,234 @@
+// Copyright (C) 2018 ecofast(胡光耀). All rights reserved.
+// Use of this source code is governed by a BSD-style license.
+
+package tcpsock
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrUnknownMsg  = errors.New("unknown message")
+	ErrMsgTooLarge = errors.New("message too large")
+)
+
+// Message is one inbound frame as seen by a Router. Body is what follows
+// the message ID; both Body and Frame are only valid until the handler
+// returns.
+type Message struct {
+	ID    uint32
+	Body  []byte
+	Frame []byte
+}
+
+// MsgParser pulls the message ID and body out of a frame.
+type MsgParser = func(frame []byte) (id uint32, body []byte, err error)
+
+// MsgHandler handles one message on behalf of session. A returned error
+// is passed on to Router.Dispatch's caller, usually a session's Read, and
+// so closes the connection.
+type MsgHandler = func(session TcpSession, msg Message) error
+
+// OnUnknownMsg handles messages whose ID has no route.
+type OnUnknownMsg = func(session TcpSession, msg Message) error
+
+// Middleware wraps a handler with behaviour of its own, e.g. a check
+// that may return early instead of calling next.
+type Middleware = func(next MsgHandler) MsgHandler
+
+// Router hands messages to the handler registered for their ID. Routes
+// and middleware must all be registered before the first Dispatch; after
+// that a Router is safe for concurrent use.
+type Router struct {
+	unknown   uint64 // first, so it is aligned on 32-bit platforms
+	parse     MsgParser
+	routes    map[uint32]*Route
+	onUnknown OnUnknownMsg
+	chain     []Middleware
+	buildOnce sync.Once
+}
+
+// Route is a single registered message ID.
+type Route struct {
+	// 64-bit atomics first, so they are aligned on 32-bit platforms
+	count    uint64
+	errors   uint64
+	tooLarge uint64
+	nanos    int64
+	id       uint32
+	handler  MsgHandler
+	chain    []Middleware
+	serveFn  MsgHandler
+	maxBody  int
+}
+
+// RouteStats is a snapshot of a route's counters.
+type RouteStats struct {
+	ID       uint32
+	Count    uint64
+	Errors   uint64
+	TooLarge uint64
+	Time     time.Duration
+}
+
+func NewRouter(parse MsgParser) *Router {
+	if parse == nil {
+		panic(errors.New("invalid param of parse for NewRouter"))
+	}
+
+	return &Router{
+		parse:  parse,
+		routes: make(map[uint32]*Route),
+	}
+}
+
+// NewIDParser returns a parser for frames carrying a size byte (1, 2 or 4)
+// message ID at offset, whose body is everything after the ID.
+func NewIDParser(offset, size int, order binary.ByteOrder) MsgParser {
+	if offset < 0 {
+		panic(errors.New("invalid param of offset for NewIDParser"))
+	}
+	if size != 1 && size != 2 && size != 4 {
+		panic(errors.New("invalid param of size for NewIDParser"))
+	}
+	if order == nil && size != 1 {
+		panic(errors.New("invalid param of order for NewIDParser"))
+	}
+
+	return func(frame []byte) (uint32, []byte, error) {
+		if len(frame) < offset+size {
+			return 0, nil, ErrInvalidFrame
+		}
+		b := frame[offset : offset+size]
+		var id uint32
+		switch size {
+		case 1:
+			id = uint32(b[0])
+		case 2:
+			id = uint32(order.Uint16(b))
+		default:
+			id = order.Uint32(b)
+		}
+		return id, frame[offset+size:], nil
+	}
+}
+
+// Handle registers handler for id, replacing any previous one.
+func (self *Router) Handle(id uint32, handler MsgHandler) *Route {
+	if handler == nil {
+		panic(errors.New("invalid param of handler for Router.Handle"))
+	}
+
+	route := &Route{id: id, handler: handler}
+	self.routes[id] = route
+	return route
+}
+
+// Use adds middleware that wraps every route as well as the unknown
+// message handler. The first one added is the outermost and runs before
+// any route's own middleware.
+func (self *Router) Use(middleware ...Middleware) {
+	self.chain = append(self.chain, middleware...)
+}
+
+// SetUnknownHandler installs onUnknown for IDs without a route. Without
+// one such messages make Dispatch return ErrUnknownMsg.
+func (self *Router) SetUnknownHandler(onUnknown OnUnknownMsg) {
+	self.onUnknown = onUnknown
+}
+
+// Dispatch parses frame and runs the matching handler. It is typically
+// called from a session's Read.
+func (self *Router) Dispatch(session TcpSession, frame []byte) error {
+	self.buildOnce.Do(self.build)
+	id, body, err := self.parse(frame)
+	if err != nil {
+		return err
+	}
+	msg := Message{ID: id, Body: body, Frame: frame}
+
+	route := self.routes[id]
+	if route == nil {
+		atomic.AddUint64(&self.unknown, 1)
+		if self.onUnknown != nil {
+			return self.onUnknown(session, msg)
+		}
+		return ErrUnknownMsg
+	}
+	return route.serve(session, msg)
+}
+
+// build wraps every handler in its middleware chain once and for all.
+func (self *Router) build() {
+	for _, route := range self.routes {
+		route.serveFn = wrap(wrap(route.handler, route.chain), self.chain)
+	}
+	if self.onUnknown != nil {
+		self.onUnknown = wrap(self.onUnknown, self.chain)
+	}
+}
+
+func wrap(handler MsgHandler, chain []Middleware) MsgHandler {
+	for i := len(chain) - 1; i >= 0; i-- {
+		handler = chain[i](handler)
+	}
+	return handler
+}
+
+// Stats returns the counters of every route, ordered by ID, along with the
+// number of messages that had no route.
+func (self *Router) Stats() (routes []RouteStats, unknown uint64) {
+	routes = make([]RouteStats, 0, len(self.routes))
+	for _, route := range self.routes {
+		routes = append(routes, route.Stats())
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		return routes[i].ID < routes[j].ID
+	})
+	return routes, atomic.LoadUint64(&self.unknown)
+}
+
+// Use adds middleware for this route only. It runs inside the router's
+// middleware, the first one added being the outermost.
+func (self *Route) Use(middleware ...Middleware) *Route {
+	self.chain = append(self.chain, middleware...)
+	return self
+}
+
+// SetMaxBody makes the route reject bodies longer than n bytes with
+// ErrMsgTooLarge; n <= 0 means no limit.
+func (self *Route) SetMaxBody(n int) *Route {
+	self.maxBody = n
+	return self
+}
+
+func (self *Route) Stats() RouteStats {
+	return RouteStats{
+		ID:       self.id,
+		Count:    atomic.LoadUint64(&self.count),
+		Errors:   atomic.LoadUint64(&self.errors),
+		TooLarge: atomic.LoadUint64(&self.tooLarge),
+		Time:     time.Duration(atomic.LoadInt64(&self.nanos)),
+	}
+}
+
+func (self *Route) serve(session TcpSession, msg Message) error {
+	atomic.AddUint64(&self.count, 1)
+	if self.maxBody > 0 && len(msg.Body) > self.maxBody {
+		atomic.AddUint64(&self.tooLarge, 1)
+		return ErrMsgTooLarge
+	}
+
+	start := time.Now()
+	err := self.serveFn(session, msg)
+	atomic.AddInt64(&self.nanos, int64(time.Since(start)))
+	if err != nil {
+		atomic.AddUint64(&self.errors, 1)
+	}
+	return err
+}
@@ -0,0 +1,142 @@
+// Copyright (C) 2018 ecofast(胡光耀). All rights reserved.
+// Use of this source code is governed by a BSD-style license.
+
+package tcpsock
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// idSession is a session that is nothing but its handle.
+type idSession uint64
+
+func (self idSession) SockHandle() uint64 {
+	return uint64(self)
+}
+
+func (self idSession) Read(b []byte) (n int, err error) {
+	return len(b), nil
+}
+
+func (self idSession) Write(b []byte) (n int, err error) {
+	return len(b), nil
+}
+
+func (self idSession) Close() error {
+	return nil
+}
+
+func TestRouterDispatch(t *testing.T) {
+	errHandler := errors.New("handler failed")
+	errUnknown := errors.New("unknown")
+	cases := []struct {
+		name      string
+		frame     []byte
+		onUnknown OnUnknownMsg
+		err       error
+		handled   uint32
+	}{
+		{"routed", []byte{1, 'h', 'i'}, nil, nil, 1},
+		{"empty body", []byte{1}, nil, nil, 1},
+		{"handler error", []byte{2}, nil, errHandler, 2},
+		{"at max body", []byte{3, 1, 2, 3, 4}, nil, nil, 3},
+		{"over max body", []byte{3, 1, 2, 3, 4, 5}, nil, ErrMsgTooLarge, 0},
+		{"unknown id", []byte{9}, nil, ErrUnknownMsg, 0},
+		{"unknown id with handler", []byte{9}, func(session TcpSession, msg Message) error {
+			return errUnknown
+		}, errUnknown, 0},
+		{"no id", []byte{}, nil, ErrInvalidFrame, 0},
+	}
+	for _, c := range cases {
+		var handled uint32
+		handler := func(session TcpSession, msg Message) error {
+			handled = msg.ID
+			if msg.ID == 2 {
+				return errHandler
+			}
+			return nil
+		}
+		r := NewRouter(NewIDParser(0, 1, nil))
+		r.Handle(1, handler)
+		r.Handle(2, handler)
+		r.Handle(3, handler).SetMaxBody(4)
+		r.SetUnknownHandler(c.onUnknown)
+
+		if err := r.Dispatch(idSession(1), c.frame); err != c.err {
+			t.Errorf("%s: got %v, want %v", c.name, err, c.err)
+		}
+		if handled != c.handled {
+			t.Errorf("%s: message %d handled, want %d", c.name, handled, c.handled)
+		}
+	}
+}
+
+func TestRouterStats(t *testing.T) {
+	r := NewRouter(NewIDParser(0, 1, nil))
+	r.Handle(2, func(session TcpSession, msg Message) error {
+		return ErrInvalidFrame
+	})
+	r.Handle(1, func(session TcpSession, msg Message) error {
+		return nil
+	}).SetMaxBody(1)
+	for _, frame := range [][]byte{{1}, {1, 0}, {1, 0, 0}, {2}, {7}, {8}} {
+		r.Dispatch(idSession(1), frame)
+	}
+
+	routes, unknown := r.Stats()
+	if unknown != 2 {
+		t.Errorf("%d unknown messages, want 2", unknown)
+	}
+	if len(routes) != 2 || routes[0].ID != 1 || routes[1].ID != 2 {
+		t.Fatalf("got routes %+v, want 1 and 2", routes)
+	}
+	if s := routes[0]; s.Count != 3 || s.TooLarge != 1 || s.Errors != 0 {
+		t.Errorf("route 1: %+v", s)
+	}
+	if s := routes[1]; s.Count != 1 || s.TooLarge != 0 || s.Errors != 1 {
+		t.Errorf("route 2: %+v", s)
+	}
+}
+
+// TestRouterMiddlewareOrder checks that the router's middleware wraps each
+// route's own, the first one added being the outermost in both.
+func TestRouterMiddlewareOrder(t *testing.T) {
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(next MsgHandler) MsgHandler {
+			return func(session TcpSession, msg Message) error {
+				calls = append(calls, name)
+				return next(session, msg)
+			}
+		}
+	}
+	handler := func(session TcpSession, msg Message) error {
+		calls = append(calls, "handler")
+		return nil
+	}
+
+	r := NewRouter(NewIDParser(0, 1, nil))
+	r.Use(trace("router 1"), trace("router 2"))
+	r.Handle(1, handler).Use(trace("route 1"), trace("route 2"))
+	r.Handle(2, handler)
+	r.SetUnknownHandler(handler)
+	cases := []struct {
+		frame []byte
+		calls []string
+	}{
+		{[]byte{1}, []string{"router 1", "router 2", "route 1", "route 2", "handler"}},
+		{[]byte{2}, []string{"router 1", "router 2", "handler"}},
+		{[]byte{3}, []string{"router 1", "router 2", "handler"}},
+	}
+	for _, c := range cases {
+		calls = nil
+		if err := r.Dispatch(idSession(1), c.frame); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(calls, c.calls) {
+			t.Errorf("message %d: got %q, want %q", c.frame[0], calls, c.calls)
+		}
+	}
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"errors"
 	"fmt"
 	"log"
 	"unsafe"
@@ -13,14 +12,12 @@ import (
 
 type client struct {
 	*tcpsock.TcpClient
-	recvBuf    []byte
-	recvBufLen int
-	roomID     uint8
-	seatID     uint8
+	roomID uint8
+	seatID uint8
 }
 
 func (self *client) SockHandle() uint64 {
-	return self.ID()
+	return self.Conn().ID()
 }
 
 func (self *client) onConnect(c *tcpsock.TcpConn) tcpsock.TcpSession {
@@ -28,49 +25,13 @@ func (self *client) onConnect(c *tcpsock.TcpConn) tcpsock.TcpSession {
 	return self
 }
 
-func (self *client) onDisconnect(c *tcpsock.TcpConn) {
-	log.Println("disconnect from server", c.RawConn().RemoteAddr().String())
+func (self *client) onDisconnect(c *tcpsock.TcpConn, reason tcpsock.CloseReason) {
+	log.Println("disconnect from server", c.RawConn().RemoteAddr().String(), reason)
 }
 
 func (self *client) Read(b []byte) (n int, err error) {
-	count := len(b)
-	if count+self.recvBufLen > tcpsock.RecvBufLenMax {
-		return 0, errors.New("invalid data")
-	}
-
-	self.recvBuf = append(self.recvBuf, b[0:count]...)
-	self.recvBufLen += count
-	offsize := 0
-	offset := 0
-	var head protocol.PacketHead
-	for self.recvBufLen-offsize > protocol.SizeOfPacketHead {
-		offset = 0
-		head.Len = uint16(uint16(self.recvBuf[offsize+1])<<8 | uint16(self.recvBuf[offsize+0]))
-		pkglen := int(protocol.SizeOfPacketHead + head.Len)
-		if pkglen >= tcpsock.RecvBufLenMax {
-			offsize = self.recvBufLen
-			break
-		}
-		if offsize+pkglen > self.recvBufLen {
-			break
-		}
-		offset += protocol.SizeOfPacketHeadLen
-		head.Cmd = uint16(uint16(self.recvBuf[offsize+offset+1])<<8 | uint16(self.recvBuf[offsize+offset+0]))
-		switch head.Cmd {
-		case protocol.PT_NORMAL:
-			offset += protocol.SizeOfPacketHeadCmd
-			self.process(self.recvBuf[offsize+offset : offsize+offset+int(head.Len)])
-		default:
-			//
-		}
-		offsize += pkglen
-	}
-
-	self.recvBufLen -= offsize
-	if self.recvBufLen > 0 {
-		self.recvBuf = self.recvBuf[offsize : offsize+self.recvBufLen]
-	} else {
-		self.recvBuf = nil
+	if BytesToUInt16(b[:protocol.SizeOfPacketHeadCmd]) == protocol.PT_NORMAL {
+		self.process(b[protocol.SizeOfPacketHeadCmd:])
 	}
 	return len(b), nil
 }
@@ -114,6 +75,9 @@ func (self *client) process(b []byte) {
 		log.Printf("[SM_CHAT] %s: %s\n", name, txt)
 	case protocol.SM_NOTIFY:
 		log.Printf("[SM_NOTIFY] %s\n", bytes2str(b[protocol.SizeOfMsgHead:]))
+	case protocol.SM_REJECT:
+		param := BytesToUInt16(b[protocol.SizeOfMsgHeadProtoID : protocol.SizeOfMsgHeadProtoID+protocol.SizeOfMsgHeadParam])
+		log.Printf("[SM_REJECT] %s, retry in %ds\n", bytes2str(b[protocol.SizeOfMsgHead:]), param)
 	default:
 		fmt.Println("?????")
 	}
@@ -129,5 +93,6 @@ func newTcpClient(addr string) *client {
 		seatID: 0xFF,
 	}
 	c.TcpClient = tcpsock.NewTcpClient(addr, c.onConnect, c.onDisconnect)
+	c.SetCodec(protocol.Codec)
 	return c
 }
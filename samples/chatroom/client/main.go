@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"math/rand"
 	"os"
@@ -43,7 +44,9 @@ func main() {
 		panic("invalid server addr")
 	}
 	cli = newTcpClient(os.Args[1])
-	cli.Open()
+	if err := cli.OpenContext(context.Background()); err != nil {
+		panic(err)
+	}
 	genUserName()
 	go input()
 	<-shutdown
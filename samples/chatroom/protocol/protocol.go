@@ -2,6 +2,8 @@ package protocol
 
 import (
 	"encoding/binary"
+
+	"tcpsock.v2"
 )
 
 const (
@@ -50,6 +52,10 @@ func (self *NetPacket) Bytes() []byte {
 	return buf
 }
 
+// Codec frames the stream by PacketHead.Len. Each decoded frame starts at
+// PacketHead.Cmd, i.e. everything that follows the length field.
+var Codec = tcpsock.NewLengthCodec(tcpsock.LenSize16, binary.LittleEndian, SizeOfPacketHeadCmd, false)
+
 func NewPacket(cmd uint16, protoID, param uint16, content []byte) *NetPacket {
 	if len(content) > 1<<16-SizeOfPacketHead-SizeOfMsgHead {
 		return nil
@@ -98,6 +104,9 @@ const (
 
 	CM_CHAT = 7
 	SM_CHAT = cCmSmDif + CM_CHAT
+
+	// Param is the number of seconds to wait before retrying, 0 for never
+	SM_REJECT = cCmSmDif + 8
 )
 
 const (
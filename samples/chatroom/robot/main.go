@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"log"
 	"math/rand"
 	"os"
 	"os/signal"
@@ -48,7 +50,10 @@ func main() {
 	for i := 0; i < robotNum; i++ {
 		go func(idx int) {
 			cli := newTcpClient(svrAddr, idx)
-			cli.Open()
+			if err := cli.OpenContext(context.Background()); err != nil {
+				log.Printf("robot %d: %v\n", idx, err)
+				return
+			}
 			cli.genUserName()
 			cli.Write(protocol.NewPacket(protocol.PT_NORMAL, protocol.CM_ENTERROOM, uint16(roomID), nil).Bytes())
 			cli.chat()
@@ -3,6 +3,7 @@ package cfgmgr
 import (
 	"log"
 	"os"
+	"strings"
 
 	"github.com/ecofast/rtl/inifiles"
 	"github.com/ecofast/rtl/sysutils"
@@ -11,6 +12,12 @@ import (
 type config struct {
 	clientListenPort int
 	snapshotLogIntv  int // secs
+	metricsPort      int
+	maxConnsPerIP    int
+	connRatePerIP    int // per sec
+	ipFilterFile     string
+	trustedProxies   []string
+	acceptRate       int // per sec
 }
 
 var (
@@ -23,8 +30,20 @@ func Setup() {
 	cfg = &config{
 		clientListenPort: ini.ReadInt("setup", "ClientListenPort", 12321),
 		snapshotLogIntv:  ini.ReadInt("setup", "SnapshotLogIntv", 0),
+		metricsPort:      ini.ReadInt("setup", "MetricsPort", 0),
+		maxConnsPerIP:    ini.ReadInt("setup", "MaxConnsPerIP", 0),
+		connRatePerIP:    ini.ReadInt("setup", "ConnRatePerIP", 0),
+		ipFilterFile:     ini.ReadString("setup", "IPFilterFile", ""),
+		acceptRate:       ini.ReadInt("setup", "AcceptRate", 0),
 	}
-	if cfg.clientListenPort <= 1024 || cfg.clientListenPort >= 65536 || cfg.snapshotLogIntv < 0 {
+	// comma separated CIDRs of load balancers sending PROXY headers
+	for _, s := range strings.Split(ini.ReadString("setup", "TrustedProxies", ""), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			cfg.trustedProxies = append(cfg.trustedProxies, s)
+		}
+	}
+	if cfg.clientListenPort <= 1024 || cfg.clientListenPort >= 65536 || cfg.snapshotLogIntv < 0 || cfg.metricsPort < 0 || cfg.metricsPort >= 65536 ||
+		cfg.maxConnsPerIP < 0 || cfg.connRatePerIP < 0 || cfg.acceptRate < 0 {
 		panic("invalid configuration!")
 	}
 	log.Println("configuration has been loaded successfully")
@@ -37,3 +56,27 @@ func ClientListenPort() int {
 func SnapshotLogIntv() int {
 	return cfg.snapshotLogIntv
 }
+
+func MetricsPort() int {
+	return cfg.metricsPort
+}
+
+func MaxConnsPerIP() int {
+	return cfg.maxConnsPerIP
+}
+
+func ConnRatePerIP() int {
+	return cfg.connRatePerIP
+}
+
+func IPFilterFile() string {
+	return cfg.ipFilterFile
+}
+
+func TrustedProxies() []string {
+	return cfg.trustedProxies
+}
+
+func AcceptRate() int {
+	return cfg.acceptRate
+}
@@ -0,0 +1,122 @@
+package clientsock
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	. "github.com/ecofast/rtl/sysutils"
+	"tcpsock.v2"
+	. "tcpsock.v2/samples/chatroom/protocol"
+	. "tcpsock.v2/samples/chatroom/server/msgnode"
+)
+
+const (
+	chatLenMax = 256
+	chatRate   = 2 // per second
+	chatBurst  = 5
+)
+
+// every message starts with its MsgHead, so a route's body is the param
+// followed by the content
+var router = newRouter()
+
+func Router() *tcpsock.Router {
+	return router
+}
+
+func newRouter() *tcpsock.Router {
+	// messages from players who haven't told us their name yet, or chat
+	// outside any room, are dropped
+	identified := tcpsock.Guard(func(session tcpsock.TcpSession, msg tcpsock.Message) bool {
+		return session.(*ClientSock).userName[0] != 0
+	}, nil)
+	inRoom := tcpsock.Guard(func(session tcpsock.TcpSession, msg tcpsock.Message) bool {
+		return session.(*ClientSock).RoomID() != 0xFF
+	}, nil)
+
+	r := tcpsock.NewRouter(tcpsock.NewIDParser(0, SizeOfMsgHeadProtoID, binary.LittleEndian))
+	r.Handle(CM_PING, onPing).SetMaxBody(SizeOfMsgHeadParam)
+	r.Handle(CM_IDENTITY, onIdentity).SetMaxBody(SizeOfMsgHeadParam + SizeOfUserName)
+	r.Handle(CM_REQROOMLIST, onReqRoomList).SetMaxBody(SizeOfMsgHeadParam)
+	r.Handle(CM_ENTERROOM, onEnterRoom).SetMaxBody(SizeOfMsgHeadParam).Use(identified)
+	r.Handle(CM_EXITROOM, onExitRoom).SetMaxBody(SizeOfMsgHeadParam)
+	r.Handle(CM_CHAT, onChat).SetMaxBody(SizeOfMsgHeadParam+chatLenMax).Use(identified, inRoom, tcpsock.RateLimit(chatRate, chatBurst, nil))
+	r.SetUnknownHandler(onUnknown)
+	return r
+}
+
+func param(msg tcpsock.Message) uint16 {
+	if len(msg.Body) < SizeOfMsgHeadParam {
+		return 0
+	}
+	return BytesToUInt16(msg.Body[:SizeOfMsgHeadParam])
+}
+
+func content(msg tcpsock.Message) []byte {
+	if len(msg.Body) < SizeOfMsgHeadParam {
+		return nil
+	}
+	return msg.Body[SizeOfMsgHeadParam:]
+}
+
+func onPing(session tcpsock.TcpSession, msg tcpsock.Message) error {
+	self := session.(*ClientSock)
+	self.Write(NewPacket(PT_NORMAL, SM_PING, 0, nil).Bytes())
+	return nil
+}
+
+func onIdentity(session tcpsock.TcpSession, msg tcpsock.Message) error {
+	self := session.(*ClientSock)
+	copy(self.userName[:], content(msg))
+	self.Write(NewPacket(PT_NORMAL, SM_IDENTITY, 0, nil).Bytes())
+	return nil
+}
+
+func onReqRoomList(session tcpsock.TcpSession, msg tcpsock.Message) error {
+	self := session.(*ClientSock)
+	self.cliChan <- &MsgNode{
+		Owner:   self,
+		ProtoID: CM_REQROOMLIST,
+	}
+	return nil
+}
+
+func onEnterRoom(session tcpsock.TcpSession, msg tcpsock.Message) error {
+	self := session.(*ClientSock)
+	if self.RoomID() != 0xFF {
+		self.Write(NewPacket(PT_NORMAL, SM_ENTERROOM, 0, nil).Bytes())
+		return nil
+	}
+	self.cliChan <- &MsgNode{
+		Owner:   self,
+		ProtoID: CM_ENTERROOM,
+		Param:   param(msg),
+	}
+	return nil
+}
+
+func onExitRoom(session tcpsock.TcpSession, msg tcpsock.Message) error {
+	self := session.(*ClientSock)
+	self.cliChan <- &MsgNode{
+		Owner:   self,
+		ProtoID: CM_EXITROOM,
+	}
+	return nil
+}
+
+func onChat(session tcpsock.TcpSession, msg tcpsock.Message) error {
+	self := session.(*ClientSock)
+	self.cliChan <- &MsgNode{
+		Owner:   self,
+		ProtoID: CM_CHAT,
+		// msg belongs to the connection's receive buffer, which is reused
+		// as soon as Read returns, so hand gamemgr a copy
+		Buf: append([]byte(nil), content(msg)...),
+	}
+	return nil
+}
+
+func onUnknown(session tcpsock.TcpSession, msg tcpsock.Message) error {
+	fmt.Printf("unknown message %d\n", msg.ID)
+	return tcpsock.ErrUnknownMsg
+}
@@ -1,9 +1,10 @@
 package gamemgr
 
 import (
+	"log"
 	"sync"
-	"time"
 
+	"tcpsock.v2"
 	"tcpsock.v2/samples/chatroom/protocol"
 	. "tcpsock.v2/samples/chatroom/server/msgnode"
 	"tcpsock.v2/samples/chatroom/server/player"
@@ -15,10 +16,8 @@ const (
 )
 
 type GameMgr struct {
-	rooms        [RoomNumMax]*room.Room
-	mutex        sync.Mutex
-	firstMsgNode *MsgNode
-	lastMsgNode  *MsgNode
+	rooms      [RoomNumMax]*room.Room
+	dispatcher *tcpsock.Dispatcher
 }
 
 var (
@@ -32,10 +31,19 @@ func Setup() {
 	}
 }
 
+// Run handles messages on a pool of workers, one player's messages always
+// in order; rooms guard themselves against players in them being handled
+// in parallel.
 func Run(exitChan chan struct{}, waitGroup *sync.WaitGroup, cliChan <-chan *MsgNode) {
 	defer waitGroup.Done()
 
-	go gameMgr.run()
+	gameMgr.dispatcher = tcpsock.NewDispatcher(0, 0)
+	gameMgr.dispatcher.SetOverloadHandler(func(key uint64) {
+		log.Printf("too many pending messages from player %d, dropped\n", key)
+	})
+	gameMgr.dispatcher.SetPanicHandler(func(key uint64, v interface{}, stack []byte) {
+		log.Printf("panic handling player %d: %v\n%s", key, v, stack)
+	})
 	go func() {
 		for node := range cliChan {
 			gameMgr.addMsgNode(node)
@@ -43,43 +51,13 @@ func Run(exitChan chan struct{}, waitGroup *sync.WaitGroup, cliChan <-chan *MsgN
 	}()
 
 	<-exitChan
+	gameMgr.dispatcher.Close()
 }
 
 func (self *GameMgr) addMsgNode(node *MsgNode) {
-	self.mutex.Lock()
-	defer self.mutex.Unlock()
-	if self.lastMsgNode != nil {
-		self.lastMsgNode.Next = node
-	}
-	if self.firstMsgNode == nil {
-		self.firstMsgNode = node
-	}
-	self.lastMsgNode = node
-}
-
-func (self *GameMgr) getMsgNode() *MsgNode {
-	var node *MsgNode
-	self.mutex.Lock()
-	defer self.mutex.Unlock()
-	if self.firstMsgNode != nil {
-		node = self.firstMsgNode
-		self.firstMsgNode = node.Next
-	}
-	if self.firstMsgNode == nil {
-		self.lastMsgNode = nil
-	}
-	return node
-}
-
-func (self *GameMgr) run() {
-	for {
-		node := self.getMsgNode()
-		if node == nil {
-			time.Sleep(5 * time.Millisecond)
-			continue
-		}
+	self.dispatcher.Submit(node.Owner.SockHandle(), func() {
 		self.process(node)
-	}
+	})
 }
 
 func (self *GameMgr) process(node *MsgNode) {
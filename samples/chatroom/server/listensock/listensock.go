@@ -1,13 +1,20 @@
 package listensock
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 
 	"tcpsock.v2"
+	"tcpsock.v2/metrics"
+	"tcpsock.v2/samples/chatroom/protocol"
 	"tcpsock.v2/samples/chatroom/server/cfgmgr"
 	"tcpsock.v2/samples/chatroom/server/clientsock"
 	. "tcpsock.v2/samples/chatroom/server/msgnode"
@@ -25,12 +32,49 @@ var (
 
 func Setup() {
 	fmt.Printf("client listen port: %d\n", cfgmgr.ClientListenPort())
+	if port := cfgmgr.MetricsPort(); port > 0 {
+		fmt.Printf("metrics listen port: %d\n", port)
+	}
 }
 
 func Run(exitChan chan struct{}, waitGroup *sync.WaitGroup, cliChan chan<- *MsgNode) {
 	defer waitGroup.Done()
 
 	chatSvr = newChatServer(fmt.Sprintf(":%d", cfgmgr.ClientListenPort()), cliChan)
+	if path := cfgmgr.IPFilterFile(); path != "" {
+		filter, err := tcpsock.LoadIPFilter(path)
+		if err != nil {
+			panic(err)
+		}
+		chatSvr.SetIPFilter(filter)
+		// SIGHUP reloads the filter; a broken file keeps the old one
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if filter, err := tcpsock.LoadIPFilter(path); err != nil {
+					log.Println("reload ip filter:", err)
+				} else {
+					chatSvr.SetIPFilter(filter)
+					log.Println("ip filter reloaded")
+				}
+			}
+		}()
+	}
+	var metricsSvr *http.Server
+	if port := cfgmgr.MetricsPort(); port > 0 {
+		collector := metrics.New(chatSvr.TcpServer, "chatroom")
+		collector.SetRouter(clientsock.Router())
+		chatSvr.SetHandlerObserver(collector.ObserveHandler)
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", collector)
+		metricsSvr = &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: mux}
+		go func() {
+			if err := metricsSvr.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Println("metrics:", err)
+			}
+		}()
+	}
 	chatSvr.Serve()
 
 	intv := cfgmgr.SnapshotLogIntv()
@@ -38,7 +82,15 @@ func Run(exitChan chan struct{}, waitGroup *sync.WaitGroup, cliChan chan<- *MsgN
 		ticker = time.NewTicker(time.Duration(intv) * time.Second)
 		go func() {
 			for range ticker.C {
-				log.Printf("Number of Concurrent Users: %d\n", chatSvr.Count())
+				stats := chatSvr.Stats()
+				log.Printf("Number of Concurrent Users: %d, accepts/s: %.1f, in: %.0f B/s, out: %.0f B/s, max queued: %d B\n",
+					stats.Active, stats.AcceptRate, stats.BytesInRate, stats.BytesOutRate, stats.MaxQueuedBytes)
+				if n := stats.Closed[tcpsock.CloseSlowConsumer]; n > 0 {
+					log.Printf("Slow consumers dropped so far: %d\n", n)
+				}
+				if bans := chatSvr.Bans(); len(bans) > 0 {
+					log.Printf("Banned IPs: %d, next to expire: %s at %s\n", len(bans), bans[0].IP, bans[0].Until.Format(time.RFC3339))
+				}
 			}
 		}()
 	}
@@ -48,25 +100,75 @@ func Run(exitChan chan struct{}, waitGroup *sync.WaitGroup, cliChan chan<- *MsgN
 	if ticker != nil {
 		ticker.Stop()
 	}
-	chatSvr.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	chatSvr.Shutdown(ctx, protocol.NewPacket(protocol.PT_NORMAL, protocol.SM_NOTIFY, 0, []byte("server is shutting down")).Bytes())
+	if metricsSvr != nil {
+		metricsSvr.Close()
+	}
 }
 
 func newChatServer(addr string, cliChan chan<- *MsgNode) *chatServer {
 	svr := &chatServer{}
 	svr.TcpServer = tcpsock.NewTcpServer(addr, svr.onConnect, svr.onDisconnect, svr.onCheckIP)
+	svr.SetCodec(protocol.Codec)
+	// a player that can't keep up must not stall the whole room
+	svr.SetSendQueue(tcpsock.SendDisconnect, 256, 64*1024, 0)
+	svr.SetErrorHandler(svr.onError)
+	svr.SetPanicHandler(svr.onPanic)
+	if err := svr.SetProxyProtocol(cfgmgr.TrustedProxies(), 0); err != nil {
+		panic(err)
+	}
+	// a connection flood is turned away at the door rather than starving
+	// the rooms
+	svr.SetAcceptRate(float64(cfgmgr.AcceptRate()), cfgmgr.AcceptRate())
+	// players arriving at a full server wait a little for a seat before
+	// being told to come back later
+	svr.SetAdmissionQueue(100, 10*time.Second)
+	svr.SetRejectHandler(tcpsock.RejectWithFrame(onRejectFrame))
+	// robots all connect from one machine, so these are off unless
+	// configured
+	svr.SetIPLimits(tcpsock.IPLimits{
+		MaxConns: cfgmgr.MaxConnsPerIP(),
+		Rate:     float64(cfgmgr.ConnRatePerIP()),
+		Burst:    cfgmgr.ConnRatePerIP(),
+		BanTime:  10 * time.Second,
+		BanMax:   10 * time.Minute,
+	})
 	svr.cliChan = cliChan
 	return svr
 }
 
+func onRejectFrame(reason tcpsock.RejectReason) []byte {
+	switch reason {
+	case tcpsock.RejectFull:
+		return protocol.NewPacket(protocol.PT_NORMAL, protocol.SM_REJECT, 30, []byte("server full, try later")).Bytes()
+	case tcpsock.RejectRate, tcpsock.RejectIPRate:
+		return protocol.NewPacket(protocol.PT_NORMAL, protocol.SM_REJECT, 5, []byte("too many connections, try later")).Bytes()
+	case tcpsock.RejectBanned, tcpsock.RejectDenied:
+		return protocol.NewPacket(protocol.PT_NORMAL, protocol.SM_REJECT, 0, []byte("access denied")).Bytes()
+	}
+	return nil
+}
+
 func (self *chatServer) onConnect(conn *tcpsock.TcpConn) tcpsock.TcpSession {
 	cli := clientsock.New(conn.ID(), conn.Write, conn.Close, self.cliChan)
 	return cli
 }
 
-func (self *chatServer) onDisconnect(conn *tcpsock.TcpConn) {
+func (self *chatServer) onDisconnect(conn *tcpsock.TcpConn, reason tcpsock.CloseReason) {
 	//
 }
 
+func (self *chatServer) onError(conn *tcpsock.TcpConn, err error) {
+	log.Printf("connection %d from %s: %v\n", conn.ID(), conn.RemoteAddr(), err)
+}
+
+func (self *chatServer) onPanic(conn *tcpsock.TcpConn, v interface{}, stack []byte) tcpsock.PanicPolicy {
+	log.Printf("panic: %v\n%s", v, stack)
+	return tcpsock.PanicClose
+}
+
 func (self *chatServer) onCheckIP(ip net.Addr) bool {
 	return true
 }
@@ -10,5 +10,4 @@ type MsgNode struct {
 	Param   uint16
 	_       uint32
 	Buf     []byte
-	Next    *MsgNode
 }
@@ -1,6 +1,8 @@
 package room
 
 import (
+	"sync"
+
 	. "tcpsock.v2/samples/chatroom/protocol"
 	"tcpsock.v2/samples/chatroom/server/player"
 )
@@ -16,6 +18,7 @@ var (
 
 type Room struct {
 	idx     uint8
+	mutex   sync.Mutex
 	players [MaxUserPerRoom]player.Player
 }
 
@@ -26,6 +29,8 @@ func New(idx uint8) *Room {
 }
 
 func (self *Room) IsFull() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
 	for i := 0; i < MaxUserPerRoom; i++ {
 		if self.players[i] == nil {
 			return false
@@ -40,6 +45,8 @@ func (self *Room) Enter(p player.Player) int {
 	buf := make([]byte, sz)
 	copy(buf[:SizeOfUserName], name)
 	copy(buf[SizeOfUserName:], enterRoomHint)
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
 	for i := range self.players {
 		if self.players[i] == nil {
 			p.EnterRoom(self.idx, uint8(i))
@@ -59,6 +66,8 @@ func (self *Room) Leave(p player.Player) bool {
 		buf := make([]byte, sz)
 		copy(buf[:SizeOfUserName], name)
 		copy(buf[SizeOfUserName:], leaveRoomHint)
+		self.mutex.Lock()
+		defer self.mutex.Unlock()
 		self.players[id] = nil
 		self.broadcast(NewPacket(PT_NORMAL, SM_NOTIFY, 0, buf).Bytes())
 		return true
@@ -70,6 +79,8 @@ func (self *Room) Chat(p player.Player, s []byte) {
 	buf := make([]byte, SizeOfUserName+len(s))
 	copy(buf[:SizeOfUserName], p.Name())
 	copy(buf[SizeOfUserName:], s)
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
 	self.broadcast(NewPacket(PT_NORMAL, SM_CHAT, 0, buf).Bytes())
 }
 
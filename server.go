@@ -4,10 +4,12 @@
 package tcpsock
 
 import (
+	"context"
 	"errors"
 	"net"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	. "github.com/ecofast/rtl/sysutils"
 )
@@ -15,18 +17,45 @@ import (
 const (
 	numOfConnInit = 100
 	NumOfConnMax  = 10000
+
+	acceptDelayMin = 5 * time.Millisecond
+	acceptDelayMax = time.Second
+
+	KickTimeoutInSecs = 2
+
+	// how many reject handlers may run at once; beyond that, connections
+	// being turned away are just closed
+	NumOfRejectMax = 64
 )
 
 type OnCheckIP = func(ip net.Addr) bool
+type OnTcpFilter = func(conn *TcpConn) bool
+type OnTcpReject = func(conn net.Conn, reason RejectReason)
 
 type TcpServer struct {
-	listener *net.TCPListener
-	*tcpSock
+	// 64-bit atomics first, so they are aligned on 32-bit platforms
 	autoIncID uint64
+	counters  serverCounters
+	listener  net.Listener
+	*tcpSock
 	count     uint32
 	mutex     sync.RWMutex
 	sessions  map[uint64]TcpSession
+	conns     map[uint64]*TcpConn
+	pending   map[net.Conn]struct{}
 	onCheckIP OnCheckIP
+	stopped   int32
+	exitOnce  sync.Once
+	ipGuard   *ipGuard
+	ipFilter  atomic.Value
+	proxyNets ipRanges
+	proxyWait time.Duration
+	connRate  *rateLimiter
+	onReject  OnTcpReject
+	rejecting chan struct{}
+	admission *admissionQueue
+	statMutex sync.Mutex
+	lastStats statsMark
 }
 
 func NewTcpServer(addr string, onConnect OnTcpConnect, onDisconnect OnTcpDisconnect, onCheckIP OnCheckIP) *TcpServer {
@@ -45,6 +74,23 @@ func NewTcpServer(addr string, onConnect OnTcpConnect, onDisconnect OnTcpDisconn
 	listener, err := net.ListenTCP("tcp", tcpAddr)
 	CheckError(err)
 
+	return NewTcpServerWithListener(listener, onConnect, onDisconnect, onCheckIP)
+}
+
+// NewTcpServerWithListener serves connections accepted from listener, which
+// may be of any kind: a Unix domain socket, an in-memory listener in tests
+// or one inherited from systemd. The server takes ownership of listener.
+func NewTcpServerWithListener(listener net.Listener, onConnect OnTcpConnect, onDisconnect OnTcpDisconnect, onCheckIP OnCheckIP) *TcpServer {
+	if listener == nil {
+		panic(errors.New("invalid param of listener for NewTcpServerWithListener"))
+	}
+	if onConnect == nil {
+		panic(errors.New("invalid param of onConnect for NewTcpServerWithListener"))
+	}
+	if onDisconnect == nil {
+		panic(errors.New("invalid param of onDisconnect for NewTcpServerWithListener"))
+	}
+
 	return &TcpServer{
 		listener: listener,
 		tcpSock: &tcpSock{
@@ -54,7 +100,11 @@ func NewTcpServer(addr string, onConnect OnTcpConnect, onDisconnect OnTcpDisconn
 			onDisconnect: onDisconnect,
 		},
 		sessions:  make(map[uint64]TcpSession, numOfConnInit),
+		conns:     make(map[uint64]*TcpConn, numOfConnInit),
+		pending:   make(map[net.Conn]struct{}),
 		onCheckIP: onCheckIP,
+		ipGuard:   newIPGuard(),
+		lastStats: statsMark{time: time.Now()},
 	}
 }
 
@@ -69,6 +119,7 @@ func (self *TcpServer) run() {
 		self.waitGroup.Done()
 	}()
 
+	var delay time.Duration
 	for {
 		select {
 		case <-self.exitChan:
@@ -76,37 +127,248 @@ func (self *TcpServer) run() {
 		default:
 		}
 
-		conn, err := self.listener.AcceptTCP()
+		conn, err := self.listener.Accept()
 		if err != nil {
+			if atomic.LoadInt32(&self.stopped) == 1 || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// e.g. out of file descriptors: back off instead of spinning
+			if delay = acceptDelay(delay); !self.sleep(delay) {
+				return
+			}
 			continue
 		}
+		delay = 0
 
-		if !self.checkConn(conn.RemoteAddr()) {
-			conn.Close()
+		if self.connRate != nil && !self.connRate.allow(0, time.Now()) {
+			self.reject(conn, conn.RemoteAddr(), RejectRate)
 			continue
 		}
+		self.admit(conn)
+	}
+}
+
+// admit screens a freshly accepted connection and, if it passes, serves it
+// on its own goroutine.
+func (self *TcpServer) admit(conn net.Conn) {
+	if self.fromProxy(conn.RemoteAddr()) {
+		// the client address is only known once the PROXY header is in,
+		// which mustn't hold up the accept loop
+		startGoroutine(func() {
+			self.serveProxied(conn)
+		}, self.waitGroup)
+		return
+	}
+
+	remote := conn.RemoteAddr()
+	if self.screen(conn, remote) {
+		startGoroutine(func() {
+			self.serveConn(conn, remote)
+		}, self.waitGroup)
+	}
+}
+
+// screen closes conn and returns false unless the peer at remote passes
+// checkConn. A panic, e.g. in onCheckIP, only drops conn.
+func (self *TcpServer) screen(conn net.Conn, remote net.Addr) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			self.recovered(nil, r)
+			self.reject(conn, remote, RejectPanic)
+			ok = false
+		}
+	}()
+
+	reason, ok := self.checkConn(remote)
+	if !ok {
+		self.reject(conn, remote, reason)
+	}
+	return ok
+}
+
+func (self *TcpServer) serveProxied(conn net.Conn) {
+	var remote net.Addr
+	var err error
+	self.settingUp(conn, func() {
+		remote, err = self.readProxyHeader(conn)
+	})
+	if err != nil {
+		self.reject(conn, conn.RemoteAddr(), RejectProxy)
+		return
+	}
+	if remote == nil {
+		remote = conn.RemoteAddr()
+	}
+	if self.screen(conn, remote) {
+		self.serveConn(conn, remote)
+	}
+}
 
-		atomic.AddUint32(&self.count, 1)
-		self.waitGroup.Add(1)
-		go func() {
-			c := newTcpConn(atomic.AddUint64(&self.autoIncID, 1), self.tcpSock, conn, self.connClose)
-			session := self.onConnect(c)
-			if session != nil {
-				c.onRead = session.Read
-				self.addSession(c.ID(), session)
+// serveConn serves conn, whose peer is at remote, which differs from
+// conn.RemoteAddr() behind a proxy.
+func (self *TcpServer) serveConn(conn net.Conn, remote net.Addr) {
+	var err error
+	self.settingUp(conn, func() {
+		conn, err = self.handshake(context.Background(), conn, self.tlsConfig, false)
+	})
+	if err != nil {
+		self.releaseIP(remote)
+		self.reject(conn, remote, RejectHandshake)
+		return
+	}
+	if !self.acquireSlot() && !self.waitSlot() {
+		self.releaseIP(remote)
+		self.reject(conn, remote, RejectFull)
+		return
+	}
+	atomic.AddUint64(&self.counters.accepted, 1)
+
+	c := newTcpConn(atomic.AddUint64(&self.autoIncID, 1), self.tcpSock, conn, self.connClose)
+	c.remote = remote
+	self.addConn(c)
+	session, err := self.connect(c)
+	if err != nil {
+		c.closeWith(ClosePanic, err)
+		return
+	}
+	if session != nil {
+		c.onRead = session.Read
+		self.addSession(c.ID(), session)
+	}
+	c.run()
+	if atomic.LoadInt32(&self.stopped) == 1 {
+		c.drain()
+	}
+}
+
+func acceptDelay(delay time.Duration) time.Duration {
+	if delay *= 2; delay < acceptDelayMin {
+		delay = acceptDelayMin
+	}
+	if delay > acceptDelayMax {
+		delay = acceptDelayMax
+	}
+	return delay
+}
+
+// sleep waits for d unless the server exits first, and reports whether it
+// didn't.
+func (self *TcpServer) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-self.exitChan:
+		return false
+	}
+}
+
+// SetAcceptRate caps how many connections per second the server takes,
+// with bursts of up to burst, before any other check; the excess is
+// rejected with RejectRate. A rate <= 0 removes the cap. It must be called
+// before serving.
+func (self *TcpServer) SetAcceptRate(rate float64, burst int) {
+	if rate <= 0 {
+		self.connRate = nil
+		return
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	self.connRate = newRateLimiter(rate, burst)
+}
+
+// SetRejectHandler installs onReject, which is called with every
+// connection the server turns away, and the reason, right before it is
+// closed. It runs on a goroutine of its own, so it may take a moment, but
+// Close and Shutdown wait for it. At most NumOfRejectMax of them run at
+// once; while they all are busy, further connections are closed without
+// calling onReject. It must be called before serving.
+func (self *TcpServer) SetRejectHandler(onReject OnTcpReject) {
+	self.onReject = onReject
+	self.rejecting = make(chan struct{}, NumOfRejectMax)
+}
+
+func (self *TcpServer) reject(conn net.Conn, remote net.Addr, reason RejectReason) {
+	self.countReject(reason)
+	if self.onReject == nil {
+		conn.Close()
+		return
+	}
+
+	// a flood of connections to turn away mustn't pile up handlers
+	select {
+	case self.rejecting <- struct{}{}:
+	default:
+		conn.Close()
+		return
+	}
+
+	// e.g. RejectWithFrame waits for the peer to read its frame, which
+	// mustn't hold up the accept loop
+	startGoroutine(func() {
+		defer func() {
+			if r := recover(); r != nil {
+				self.recovered(nil, r)
 			}
-			c.run()
-			self.waitGroup.Done()
+			conn.Close()
+			<-self.rejecting
 		}()
-	}
+		self.onReject(peerConn(conn, remote), reason)
+	}, self.waitGroup)
 }
 
 func (self *TcpServer) Close() {
-	self.listener.Close()
-	close(self.exitChan)
+	self.stop()
+	self.exit()
+	// a send goroutine blocked writing to a peer that doesn't read only
+	// notices once the connection is closed
+	for _, conn := range self.allConns() {
+		conn.closeWith(CloseShutdown, nil)
+	}
 	self.waitGroup.Wait()
 }
 
+// Shutdown stops accepting, lets each connection's send queue drain,
+// sends farewell (if any, already encoded) after it and then closes the
+// connections with CloseShutdown. Connections still open when ctx is done
+// are closed at once and ctx.Err() is returned. Those still being set up,
+// i.e. reading the PROXY header or in the TLS handshake, are dropped right
+// away. Running onConnect and reject handlers can't be cut short, so one
+// that blocks holds up Shutdown past ctx until it returns.
+func (self *TcpServer) Shutdown(ctx context.Context, farewell []byte) error {
+	self.stop()
+	for _, conn := range self.allConns() {
+		// the farewell bypasses the send queue's limits, so a peer that
+		// isn't reading can hold things up only until ctx is done
+		conn.drainWith(CloseShutdown, farewell)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		self.waitGroup.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		for _, conn := range self.allConns() {
+			conn.closeWith(CloseShutdown, nil)
+		}
+	}
+	self.exit()
+	<-done
+	return err
+}
+
+func (self *TcpServer) Addr() net.Addr {
+	return self.listener.Addr()
+}
+
 func (self *TcpServer) Count() uint32 {
 	return atomic.LoadUint32(&self.count)
 }
@@ -119,11 +381,19 @@ func (self *TcpServer) Iterate(fn OnTcpIterate) {
 	}
 }
 
+// IterateConns calls fn for every open connection, e.g. to look at their
+// Stats. Unlike Iterate it holds no lock while fn runs.
+func (self *TcpServer) IterateConns(fn OnTcpIterateConn) {
+	for _, conn := range self.allConns() {
+		fn(conn)
+	}
+}
+
 func (self *TcpServer) Send(id uint64, b []byte) {
 	if len(b) == 0 {
 		return
 	}
-	
+
 	self.mutex.RLock()
 	if v, ok := self.sessions[id]; ok {
 		v.Write(b)
@@ -131,10 +401,34 @@ func (self *TcpServer) Send(id uint64, b []byte) {
 	self.mutex.RUnlock()
 }
 
-func (self *TcpServer) Kick(id uint64) {
-	self.mutex.Lock()
-	delete(self.sessions, id)
-	self.mutex.Unlock()
+// Kick writes farewell (if any, already encoded) to connection id after
+// whatever is queued and then closes it with CloseKicked. If the peer
+// doesn't take it all within timeout (KickTimeoutInSecs if <= 0), the
+// connection is closed regardless. It reports whether id was found.
+func (self *TcpServer) Kick(id uint64, farewell []byte, timeout time.Duration) bool {
+	self.mutex.RLock()
+	conn, ok := self.conns[id]
+	self.mutex.RUnlock()
+	if !ok {
+		return false
+	}
+
+	conn.kick(farewell, kickTimeout(timeout))
+	return true
+}
+
+// KickWhere kicks, as Kick does, every connection for which match returns
+// true, and returns how many there were.
+func (self *TcpServer) KickWhere(match OnTcpFilter, farewell []byte, timeout time.Duration) int {
+	timeout = kickTimeout(timeout)
+	cnt := 0
+	for _, conn := range self.allConns() {
+		if match(conn) {
+			conn.kick(farewell, timeout)
+			cnt++
+		}
+	}
+	return cnt
 }
 
 func (self *TcpServer) GetSession(id uint64) TcpSession {
@@ -147,26 +441,118 @@ func (self *TcpServer) GetSession(id uint64) TcpSession {
 	return ret
 }
 
-func (self *TcpServer) checkConn(ip net.Addr) bool {
-	if self.Count() >= NumOfConnMax {
-		return false
+func (self *TcpServer) stop() {
+	atomic.StoreInt32(&self.stopped, 1)
+	self.listener.Close()
+	// a connection still being set up would only be drained right away,
+	// and would hold up Shutdown and Close until it timed out
+	self.mutex.Lock()
+	for conn := range self.pending {
+		conn.Close()
+	}
+	self.mutex.Unlock()
+	if self.admission != nil {
+		self.admission.stop()
+	}
+}
+
+// settingUp runs fn, which reads from or handshakes conn before it is
+// served, such that stopping the server aborts fn by closing conn.
+func (self *TcpServer) settingUp(conn net.Conn, fn func()) {
+	self.mutex.Lock()
+	if atomic.LoadInt32(&self.stopped) == 1 {
+		conn.Close()
+	} else {
+		self.pending[conn] = struct{}{}
+	}
+	self.mutex.Unlock()
+
+	fn()
+
+	self.mutex.Lock()
+	delete(self.pending, conn)
+	self.mutex.Unlock()
+}
+
+func (self *TcpServer) exit() {
+	self.exitOnce.Do(func() {
+		close(self.exitChan)
+	})
+}
+
+func (self *TcpServer) allConns() []*TcpConn {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	conns := make([]*TcpConn, 0, len(self.conns))
+	for _, conn := range self.conns {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+func kickTimeout(timeout time.Duration) time.Duration {
+	if timeout <= 0 {
+		return KickTimeoutInSecs * time.Second
+	}
+	return timeout
+}
+
+func (self *TcpServer) checkConn(ip net.Addr) (RejectReason, bool) {
+	if self.Count() >= NumOfConnMax && self.admission == nil {
+		return RejectFull, false
+	}
+
+	if !self.filterIP(ip) {
+		return RejectDenied, false
 	}
 
 	if (self.onCheckIP != nil) && (!self.onCheckIP(ip)) {
-		return false
+		return RejectCheckIP, false
 	}
 
-	return true
+	if key := addrIP(ip); key != "" {
+		return self.ipGuard.admit(key, time.Now())
+	}
+	return 0, true
+}
+
+func (self *TcpServer) releaseIP(addr net.Addr) {
+	if key := addrIP(addr); key != "" {
+		self.ipGuard.release(key)
+	}
+}
+
+// acquireSlot counts a connection in unless NumOfConnMax is reached. It
+// runs only once a connection is fully established, so that e.g. failed
+// TLS handshakes never take up a slot.
+func (self *TcpServer) acquireSlot() bool {
+	for {
+		count := atomic.LoadUint32(&self.count)
+		if count >= NumOfConnMax {
+			return false
+		}
+		if atomic.CompareAndSwapUint32(&self.count, count, count+1) {
+			return true
+		}
+	}
 }
 
-func (self *TcpServer) connClose(conn *TcpConn) {
-	atomic.AddUint32(&self.count, ^uint32(0))
+func (self *TcpServer) connClose(conn *TcpConn, reason CloseReason) {
+	self.releaseSlot()
+	atomic.AddUint64(&self.counters.closed[reason], 1)
+	self.releaseIP(conn.RemoteAddr())
 	if self.onDisconnect != nil {
-		self.onDisconnect(conn)
+		self.onDisconnect(conn, reason)
 	}
 	self.delSession(conn.ID())
 }
 
+func (self *TcpServer) addConn(conn *TcpConn) {
+	self.mutex.Lock()
+	self.conns[conn.ID()] = conn
+	self.mutex.Unlock()
+}
+
 func (self *TcpServer) addSession(id uint64, session TcpSession) {
 	self.mutex.Lock()
 	self.sessions[id] = session
@@ -176,5 +562,6 @@ func (self *TcpServer) addSession(id uint64, session TcpSession) {
 func (self *TcpServer) delSession(id uint64) {
 	self.mutex.Lock()
 	delete(self.sessions, id)
+	delete(self.conns, id)
 	self.mutex.Unlock()
 }
@@ -0,0 +1,321 @@
+// Copyright (C) 2018 ecofast(胡光耀). All rights reserved.
+// Use of this source code is governed by a BSD-style license.
+
+package tcpsock
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testTLSConfig(tb testing.TB) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "tcpsock"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func newTestServer(tb testing.TB, onConnect OnTcpConnect) *TcpServer {
+	if onConnect == nil {
+		onConnect = func(conn *TcpConn) TcpSession {
+			return nil
+		}
+	}
+	return NewTcpServer("127.0.0.1:0", onConnect, func(conn *TcpConn, reason CloseReason) {}, nil)
+}
+
+// TestStopAbortsSetUp checks that a peer that connects and then sends
+// nothing doesn't hold up Close until the set up times out.
+func TestStopAbortsSetUp(t *testing.T) {
+	cases := map[string]func(svr *TcpServer){
+		"tls": func(svr *TcpServer) {
+			svr.SetTLSConfig(testTLSConfig(t), 0)
+		},
+		"proxy": func(svr *TcpServer) {
+			svr.SetProxyProtocol([]string{"127.0.0.0/8"}, 0)
+		},
+	}
+	for name, setUp := range cases {
+		svr := newTestServer(t, nil)
+		setUp(svr)
+		svr.Serve()
+		peer, err := net.Dial("tcp", svr.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+
+		start := time.Now()
+		svr.Close()
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%s: Close took %v", name, elapsed)
+		}
+		peer.Close()
+	}
+}
+
+// TestShutdownDeadline checks that Shutdown returns soon after ctx is done,
+// whatever its connections are up to.
+func TestShutdownDeadline(t *testing.T) {
+	cases := map[string]struct {
+		setUp func(svr *TcpServer)
+		err   error
+	}{
+		// a peer that doesn't read, so the send queue is full and the
+		// farewell can't go out
+		"stuck peer": {func(svr *TcpServer) {
+			svr.SetSendQueue(SendBlock, 2, 0, 0)
+		}, context.DeadlineExceeded},
+		"tls handshake": {func(svr *TcpServer) {
+			svr.SetTLSConfig(testTLSConfig(t), 0)
+		}, nil},
+		"proxy header": {func(svr *TcpServer) {
+			svr.SetProxyProtocol([]string{"127.0.0.0/8"}, 0)
+		}, nil},
+	}
+	for name, c := range cases {
+		svr := newTestServer(t, func(conn *TcpConn) TcpSession {
+			go func() {
+				chunk := make([]byte, 16*1024)
+				for {
+					if _, err := conn.Write(chunk); err != nil {
+						return
+					}
+				}
+			}()
+			return nil
+		})
+		c.setUp(svr)
+		svr.Serve()
+		peer, err := net.Dial("tcp", svr.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(200 * time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		start := time.Now()
+		err = svr.Shutdown(ctx, []byte("bye"))
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%s: Shutdown took %v", name, elapsed)
+		}
+		if err != c.err {
+			t.Errorf("%s: Shutdown returned %v, want %v", name, err, c.err)
+		}
+		cancel()
+		peer.Close()
+	}
+}
+
+// TestRejectHandlerCap checks that connections turned away while every
+// reject handler is busy are closed without waiting for one.
+func TestRejectHandlerCap(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	svr := newTestServer(t, nil)
+	svr.SetAcceptRate(0.001, 1)
+	svr.SetRejectHandler(func(conn net.Conn, reason RejectReason) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+	})
+	svr.Serve()
+	defer svr.Close()
+	defer close(release)
+
+	// the first one uses up the burst and is let in
+	peers := make([]net.Conn, 0, NumOfRejectMax+11)
+	defer func() {
+		for _, peer := range peers {
+			peer.Close()
+		}
+	}()
+	for i := 0; i < NumOfRejectMax+11; i++ {
+		peer, err := net.Dial("tcp", svr.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		peers = append(peers, peer)
+	}
+
+	// the first NumOfRejectMax rejected ones are held by their handlers,
+	// the rest are closed at once
+	for i, peer := range peers[NumOfRejectMax+1:] {
+		peer.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := peer.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("peer %d: got %v, want io.EOF", i, err)
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != NumOfRejectMax {
+		t.Errorf("%d reject handlers ran, want %d", n, NumOfRejectMax)
+	}
+}
+
+func TestKick(t *testing.T) {
+	cases := []struct {
+		name  string
+		stuck bool
+	}{
+		// a peer that reads gets what was queued, then the farewell
+		{"reading peer", false},
+		// one that doesn't is cut off once the timeout has passed
+		{"stuck peer", true},
+	}
+	for _, c := range cases {
+		connChan := make(chan *TcpConn, 1)
+		closeChan := make(chan CloseReason, 1)
+		svr := NewTcpServer("127.0.0.1:0", func(conn *TcpConn) TcpSession {
+			connChan <- conn
+			return nil
+		}, func(conn *TcpConn, reason CloseReason) {
+			closeChan <- reason
+		}, nil)
+		svr.SetSendQueue(SendBlock, 2, 0, 0)
+		svr.Serve()
+		peer, err := net.Dial("tcp", svr.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn := <-connChan
+
+		if c.stuck {
+			go func() {
+				chunk := make([]byte, 16*1024)
+				for {
+					if _, err := conn.Write(chunk); err != nil {
+						return
+					}
+				}
+			}()
+			time.Sleep(100 * time.Millisecond)
+		} else {
+			conn.Write([]byte("hello "))
+		}
+
+		start := time.Now()
+		if !svr.Kick(conn.ID(), []byte("bye"), 200*time.Millisecond) {
+			t.Fatalf("%s: connection %d not found", c.name, conn.ID())
+		}
+		if !c.stuck {
+			peer.SetReadDeadline(time.Now().Add(time.Second))
+			if b, err := io.ReadAll(peer); err != nil || string(b) != "hello bye" {
+				t.Errorf("%s: peer got %q, %v, want %q", c.name, b, err, "hello bye")
+			}
+		}
+		select {
+		case reason := <-closeChan:
+			if reason != CloseKicked {
+				t.Errorf("%s: closed with %v, want CloseKicked", c.name, reason)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s: still open a second after Kick", c.name)
+		}
+		if c.stuck && time.Since(start) < 200*time.Millisecond {
+			t.Errorf("%s: closed before the timeout", c.name)
+		}
+
+		if svr.Kick(conn.ID(), nil, 0) {
+			t.Errorf("%s: kicked connection %d found again", c.name, conn.ID())
+		}
+		peer.Close()
+		svr.Close()
+	}
+}
+
+func TestKickWhere(t *testing.T) {
+	connChan := make(chan *TcpConn, 3)
+	svr := newTestServer(t, func(conn *TcpConn) TcpSession {
+		connChan <- conn
+		return nil
+	})
+	svr.Serve()
+	defer svr.Close()
+	for i := 0; i < 3; i++ {
+		peer, err := net.Dial("tcp", svr.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer peer.Close()
+	}
+	keep := (<-connChan).ID()
+	<-connChan
+	<-connChan
+
+	n := svr.KickWhere(func(conn *TcpConn) bool {
+		return conn.ID() != keep
+	}, nil, 0)
+	if n != 2 {
+		t.Errorf("kicked %d connections, want 2", n)
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(svr.allConns()) > 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if conns := svr.allConns(); len(conns) != 1 || conns[0].ID() != keep {
+		t.Errorf("%d connections left, want only %d", len(conns), keep)
+	}
+}
+
+// TestAcceptRate checks that connections beyond the accept rate are turned
+// away with RejectRate, and that the rest are served.
+func TestAcceptRate(t *testing.T) {
+	connChan := make(chan *TcpConn, 5)
+	rejectChan := make(chan RejectReason, 5)
+	svr := newTestServer(t, func(conn *TcpConn) TcpSession {
+		connChan <- conn
+		return nil
+	})
+	svr.SetAcceptRate(0.001, 2)
+	svr.SetRejectHandler(func(conn net.Conn, reason RejectReason) {
+		rejectChan <- reason
+	})
+	svr.Serve()
+	defer svr.Close()
+
+	for i := 0; i < 5; i++ {
+		peer, err := net.Dial("tcp", svr.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer peer.Close()
+	}
+	// the handlers race each other, so only the totals are certain
+	served := 0
+	for i := 0; i < 5; i++ {
+		select {
+		case <-connChan:
+			served++
+		case reason := <-rejectChan:
+			if reason != RejectRate {
+				t.Errorf("rejected with %v, want RejectRate", reason)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%d connections neither served nor rejected", 5-i)
+		}
+	}
+	if served != 2 {
+		t.Errorf("%d connections served, want 2", served)
+	}
+}
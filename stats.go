@@ -0,0 +1,244 @@
+// Copyright (C) 2018 ecofast(胡光耀). All rights reserved.
+// Use of this source code is governed by a BSD-style license.
+
+package tcpsock
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// RejectReason tells why the server turned a new connection away.
+type RejectReason int
+
+const (
+	// RejectFull means NumOfConnMax connections were already open.
+	RejectFull RejectReason = iota
+	// RejectCheckIP means onCheckIP returned false.
+	RejectCheckIP
+	// RejectHandshake means the TLS handshake failed or timed out.
+	RejectHandshake
+	// RejectPanic means a panic was raised while screening the connection.
+	RejectPanic
+	// RejectBanned means the IP is on the ban list.
+	RejectBanned
+	// RejectIPLimit means the IP already had IPLimits.MaxConns open.
+	RejectIPLimit
+	// RejectIPRate means the IP connected faster than IPLimits.Rate.
+	RejectIPRate
+	// RejectDenied means the IPFilter refused the IP.
+	RejectDenied
+	// RejectProxy means a trusted proxy sent no valid PROXY header in time.
+	RejectProxy
+	// RejectRate means the server was accepting faster than SetAcceptRate
+	// allows.
+	RejectRate
+
+	numOfRejectReasons
+)
+
+var rejectReasonNames = [numOfRejectReasons]string{
+	RejectFull:      "server full",
+	RejectCheckIP:   "ip check",
+	RejectHandshake: "handshake",
+	RejectPanic:     "panic",
+	RejectBanned:    "banned",
+	RejectIPLimit:   "ip limit",
+	RejectIPRate:    "ip rate",
+	RejectDenied:    "ip filter",
+	RejectProxy:     "proxy header",
+	RejectRate:      "accept rate",
+}
+
+func (self RejectReason) String() string {
+	if self >= 0 && self < numOfRejectReasons {
+		return rejectReasonNames[self]
+	}
+	return fmt.Sprintf("RejectReason(%d)", int(self))
+}
+
+const numOfCloseReasons = len(closeReasonNames)
+
+// ConnStats is a snapshot of one connection's traffic.
+type ConnStats struct {
+	ID          uint64
+	ConnectedAt time.Time
+	LastRead    time.Time
+	LastWrite   time.Time
+	BytesIn     uint64
+	BytesOut    uint64
+	FramesIn    uint64
+	FramesOut   uint64
+	QueuedMsgs  int
+	QueuedBytes int
+}
+
+// LastActive returns when the connection last read or wrote anything.
+func (self ConnStats) LastActive() time.Time {
+	if self.LastRead.After(self.LastWrite) {
+		return self.LastRead
+	}
+	return self.LastWrite
+}
+
+// ServerStats is a snapshot of a server's counters. Rates are per second,
+// averaged over the time since the previous call to TcpServer.Stats (or
+// since the server was created), so Stats is best called from a single
+// place such as a logging ticker.
+type ServerStats struct {
+	Time        time.Time
+	Active      uint32
+	Accepted    uint64
+	Rejected    map[RejectReason]uint64
+	Closed      map[CloseReason]uint64
+	BytesIn     uint64
+	BytesOut    uint64
+	FramesIn    uint64
+	FramesOut   uint64
+	QueuedMsgs  int
+	QueuedBytes int
+	// Waiting is the number of new connections in the admission queue.
+	Waiting int
+	// MaxQueuedBytes is the deepest send queue, in bytes, of any open
+	// connection; a steadily high value points at slow consumers.
+	MaxQueuedBytes int
+
+	AcceptRate   float64
+	RejectRate   float64
+	CloseRate    float64
+	BytesInRate  float64
+	BytesOutRate float64
+}
+
+// traffic counts bytes and frames in each direction.
+type traffic struct {
+	bytesIn   uint64
+	bytesOut  uint64
+	framesIn  uint64
+	framesOut uint64
+}
+
+// serverCounters holds the server wide counters behind ServerStats.
+type serverCounters struct {
+	accepted uint64
+	rejected [numOfRejectReasons]uint64
+	closed   [numOfCloseReasons]uint64
+}
+
+func (self *TcpConn) Stats() ConnStats {
+	msgs, bytes := self.QueueLen()
+	return ConnStats{
+		ID:          self.id,
+		ConnectedAt: self.startTime,
+		LastRead:    time.Unix(0, atomic.LoadInt64(&self.lastRead)),
+		LastWrite:   time.Unix(0, atomic.LoadInt64(&self.lastWrite)),
+		BytesIn:     atomic.LoadUint64(&self.traffic.bytesIn),
+		BytesOut:    atomic.LoadUint64(&self.traffic.bytesOut),
+		FramesIn:    atomic.LoadUint64(&self.traffic.framesIn),
+		FramesOut:   atomic.LoadUint64(&self.traffic.framesOut),
+		QueuedMsgs:  msgs,
+		QueuedBytes: bytes,
+	}
+}
+
+func (self *TcpConn) countIn(bytes, frames int) {
+	for _, t := range [...]*traffic{&self.traffic, &self.owner.totals} {
+		atomic.AddUint64(&t.bytesIn, uint64(bytes))
+		atomic.AddUint64(&t.framesIn, uint64(frames))
+	}
+}
+
+func (self *TcpConn) countOut(bytes, frames int) {
+	for _, t := range [...]*traffic{&self.traffic, &self.owner.totals} {
+		atomic.AddUint64(&t.bytesOut, uint64(bytes))
+		atomic.AddUint64(&t.framesOut, uint64(frames))
+	}
+}
+
+// SetHandlerObserver installs onHandled, which is told how long the
+// session's Read took for every frame, e.g. to feed a latency histogram.
+// It must be called before serving or opening.
+func (self *tcpSock) SetHandlerObserver(onHandled OnTcpHandled) {
+	self.onHandled = onHandled
+}
+
+func (self *tcpSock) handled(conn *TcpConn, start time.Time) {
+	self.onHandled(conn, time.Since(start))
+}
+
+// Stats returns a snapshot of the server's counters along with rates since
+// the previous call.
+func (self *TcpServer) Stats() ServerStats {
+	stats := self.Totals()
+	var rejected, closed uint64
+	for _, n := range stats.Rejected {
+		rejected += n
+	}
+	for _, n := range stats.Closed {
+		closed += n
+	}
+
+	self.statMutex.Lock()
+	last := self.lastStats
+	self.lastStats = statsMark{stats.Time, stats.Accepted, rejected, closed, stats.BytesIn, stats.BytesOut}
+	self.statMutex.Unlock()
+	if secs := stats.Time.Sub(last.time).Seconds(); secs > 0 {
+		stats.AcceptRate = float64(stats.Accepted-last.accepted) / secs
+		stats.RejectRate = float64(rejected-last.rejected) / secs
+		stats.CloseRate = float64(closed-last.closed) / secs
+		stats.BytesInRate = float64(stats.BytesIn-last.bytesIn) / secs
+		stats.BytesOutRate = float64(stats.BytesOut-last.bytesOut) / secs
+	}
+	return stats
+}
+
+// Totals is Stats without the rates. It leaves the rate window alone, so
+// scrapers such as the metrics package can call it as often as they like.
+func (self *TcpServer) Totals() ServerStats {
+	stats := ServerStats{
+		Time:      time.Now(),
+		Active:    self.Count(),
+		Accepted:  atomic.LoadUint64(&self.counters.accepted),
+		Rejected:  make(map[RejectReason]uint64),
+		Closed:    make(map[CloseReason]uint64),
+		BytesIn:   atomic.LoadUint64(&self.totals.bytesIn),
+		BytesOut:  atomic.LoadUint64(&self.totals.bytesOut),
+		FramesIn:  atomic.LoadUint64(&self.totals.framesIn),
+		FramesOut: atomic.LoadUint64(&self.totals.framesOut),
+		Waiting:   self.queued(),
+	}
+	for i := range self.counters.rejected {
+		if n := atomic.LoadUint64(&self.counters.rejected[i]); n > 0 {
+			stats.Rejected[RejectReason(i)] = n
+		}
+	}
+	for i := range self.counters.closed {
+		if n := atomic.LoadUint64(&self.counters.closed[i]); n > 0 {
+			stats.Closed[CloseReason(i)] = n
+		}
+	}
+	for _, conn := range self.allConns() {
+		msgs, bytes := conn.QueueLen()
+		stats.QueuedMsgs += msgs
+		stats.QueuedBytes += bytes
+		if bytes > stats.MaxQueuedBytes {
+			stats.MaxQueuedBytes = bytes
+		}
+	}
+	return stats
+}
+
+// statsMark remembers the totals of the previous Stats call for rates.
+type statsMark struct {
+	time     time.Time
+	accepted uint64
+	rejected uint64
+	closed   uint64
+	bytesIn  uint64
+	bytesOut uint64
+}
+
+func (self *TcpServer) countReject(reason RejectReason) {
+	atomic.AddUint64(&self.counters.rejected[reason], 1)
+}
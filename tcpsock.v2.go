@@ -6,20 +6,50 @@
 package tcpsock
 
 import (
+	"crypto/tls"
 	"sync"
+	"time"
 )
 
 type OnTcpConnect = func(conn *TcpConn) TcpSession
-type OnTcpDisconnect = func(conn *TcpConn)
+type OnTcpDisconnect = func(conn *TcpConn, reason CloseReason)
 type OnTcpError = func(conn *TcpConn, err error)
 type OnTcpIterate = func(id uint64, session TcpSession)
+type OnTcpIterateConn = func(conn *TcpConn)
+
+type OnTcpPing = func(conn *TcpConn) []byte
+type OnTcpHandled = func(conn *TcpConn, elapsed time.Duration)
 
 type OnTcpWrite = func(b []byte) (n int, err error)
 type OnTcpClose = func() error
 
 type tcpSock struct {
-	exitChan     chan struct{}
-	waitGroup    *sync.WaitGroup
-	onConnect    OnTcpConnect
-	onDisconnect OnTcpDisconnect
+	totals         traffic
+	exitChan       chan struct{}
+	waitGroup      *sync.WaitGroup
+	onConnect      OnTcpConnect
+	onDisconnect   OnTcpDisconnect
+	onError        OnTcpError
+	onPanic        OnTcpPanic
+	onHandled      OnTcpHandled
+	codec          Codec
+	readIdle       time.Duration
+	writeIdle      time.Duration
+	totalIdle      time.Duration
+	pingIntv       time.Duration
+	onPing         OnTcpPing
+	sendPolicy     SendPolicy
+	sendQueueLen   int
+	sendQueueBytes int
+	sendTimeout    time.Duration
+	batchBytes     int
+	writeWindow    time.Duration
+	tlsConfig      *tls.Config
+	tlsTimeout     time.Duration
+}
+
+// SetCodec makes connections deliver whole frames to their sessions instead
+// of raw chunks. It must be called before serving or opening.
+func (self *tcpSock) SetCodec(codec Codec) {
+	self.codec = codec
 }
@@ -0,0 +1,59 @@
+// Copyright (C) 2018 ecofast(胡光耀). All rights reserved.
+// Use of this source code is governed by a BSD-style license.
+
+package tcpsock
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+const (
+	TlsHandshakeTimeoutInSecs = 5
+)
+
+// SetTLSConfig encrypts every connection with config. The handshake has to
+// complete within timeout (TlsHandshakeTimeoutInSecs if <= 0) before
+// onConnect runs. A server turns away connections that fail it with
+// RejectHandshake, through the reject handler if one is set; a client gets
+// the error from OpenContext. A client without config.ServerName verifies
+// the host it dials. It must be called before serving or opening.
+func (self *tcpSock) SetTLSConfig(config *tls.Config, timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = TlsHandshakeTimeoutInSecs * time.Second
+	}
+	self.tlsConfig = config
+	self.tlsTimeout = timeout
+}
+
+// handshake wraps conn in TLS when config is set, as the client or server
+// side. On error the caller still owns and must close conn.
+func (self *tcpSock) handshake(ctx context.Context, conn net.Conn, config *tls.Config, client bool) (net.Conn, error) {
+	if config == nil {
+		return conn, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, self.tlsTimeout)
+	defer cancel()
+	var tlsConn *tls.Conn
+	if client {
+		tlsConn = tls.Client(conn, config)
+	} else {
+		tlsConn = tls.Server(conn, config)
+	}
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return conn, err
+	}
+	return tlsConn, nil
+}
+
+// TLSState returns the negotiated TLS parameters, such as the peer
+// certificates and the ALPN protocol, if the connection is encrypted.
+func (self *TcpConn) TLSState() (tls.ConnectionState, bool) {
+	if tlsConn, ok := self.conn.(*tls.Conn); ok {
+		return tlsConn.ConnectionState(), true
+	}
+	return tls.ConnectionState{}, false
+}